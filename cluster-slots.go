@@ -0,0 +1,222 @@
+// cluster-slots handles presenting a tier of proxies to clients as a Redis Cluster, each proxy serving a slice of the slots.
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+)
+
+// slotRange is a range of hash slots (inclusive) served by the proxy at addr.
+type slotRange struct {
+	start, end int
+	addr       string
+}
+
+// The slot map of the proxy tier (nil unless it is presented as a cluster),
+// and the address among it that clients reach this proxy at
+var servedSlots []slotRange
+var announceAddr string
+
+// slotOwner returns the address of the proxy serving the slot ("" if none is).
+func slotOwner(slot int) string {
+
+	for _, r := range servedSlots {
+		if slot >= r.start && slot <= r.end {
+			return r.addr
+		}
+	}
+	return ""
+}
+
+// movedReply returns the error for keys in different slots, else the redirect
+// for keys served by another proxy (or the error for a slot no proxy serves).
+func movedReply(keys []string) (respValue, bool) {
+
+	if len(keys) == 0 {
+		return respValue{}, false
+	}
+	slot := int(cluster.Slot(keys[0]))
+	for _, key := range keys[1:] {
+		if int(cluster.Slot(key)) != slot {
+			return respErr(errCrossSlot.Error()), true
+		}
+	}
+	switch owner := slotOwner(slot); owner {
+	case announceAddr:
+		return respValue{}, false
+	case "":
+		return respErr("CLUSTERDOWN Hash slot not served"), true
+	default:
+		return respErr(fmt.Sprintf("MOVED %d %s", slot, owner)), true
+	}
+}
+
+// servedKeys returns the keys of the command which only the proxy serving
+// them may answer: those of cached reads and of writes. Other reads are
+// simply forwarded, which any proxy can do.
+func servedKeys(args [][]byte) []string {
+
+	name := strings.ToUpper(string(args[0]))
+	if name == "GET" && len(args) == 2 || name == "MGET" {
+		keys := make([]string, len(args)-1)
+		for i, arg := range args[1:] {
+			keys[i] = string(arg)
+		}
+		return keys
+	}
+	if isCachedCommand(args) {
+		return []string{string(args[1])}
+	}
+	keys, _ := writtenKeys(args)
+	return keys
+}
+
+// nodeID derives the (40 character) cluster node ID of a proxy from its address.
+func nodeID(addr string) string {
+
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// slotNodes returns the addresses of the proxies in the slot map, in order.
+func slotNodes() []string {
+
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, r := range servedSlots {
+		if !seen[r.addr] {
+			seen[r.addr] = true
+			addrs = append(addrs, r.addr)
+		}
+	}
+	return addrs
+}
+
+func splitAddr(addr string) (host string, port int) {
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ = strconv.Atoi(portStr)
+	return host, port
+}
+
+// serveClusterCommand answers the CLUSTER commands used by cluster-aware
+// clients to find the proxy serving each slot.
+func serveClusterCommand(args [][]byte) respValue {
+
+	if len(args) < 2 {
+		return wrongArity(args)
+	}
+	switch strings.ToUpper(string(args[1])) {
+	case "SLOTS":
+		return clusterSlots()
+	case "SHARDS":
+		return clusterShards()
+	case "NODES":
+		return respBulk([]byte(clusterNodes()))
+	case "INFO":
+		return respBulk([]byte(clusterInfo()))
+	case "MYID":
+		return respBulk([]byte(nodeID(announceAddr)))
+	case "KEYSLOT":
+		if len(args) != 3 {
+			return wrongArity(args)
+		}
+		return respInt(int64(cluster.Slot(string(args[2]))))
+	}
+	return respErr(fmt.Sprintf("ERR 'cluster|%s' is not supported through this proxy", strings.ToLower(errorArg(args[1]))))
+}
+
+// clusterSlots replies with each range: [start, end, [host, port, id]].
+func clusterSlots() respValue {
+
+	ranges := make([]respValue, len(servedSlots))
+	for i, r := range servedSlots {
+		host, port := splitAddr(r.addr)
+		ranges[i] = respArrayOf(
+			respInt(int64(r.start)), respInt(int64(r.end)),
+			respArrayOf(respBulk([]byte(host)), respInt(int64(port)), respBulk([]byte(nodeID(r.addr)))),
+		)
+	}
+	return respArrayOf(ranges...)
+}
+
+// clusterShards replies with the slots of each proxy, as a shard of one master.
+func clusterShards() respValue {
+
+	var shards []respValue
+	for _, addr := range slotNodes() {
+		var slots []respValue
+		for _, r := range servedSlots {
+			if r.addr == addr {
+				slots = append(slots, respInt(int64(r.start)), respInt(int64(r.end)))
+			}
+		}
+		host, port := splitAddr(addr)
+		node := respMapOf(
+			respBulk([]byte("id")), respBulk([]byte(nodeID(addr))),
+			respBulk([]byte("port")), respInt(int64(port)),
+			respBulk([]byte("ip")), respBulk([]byte(host)),
+			respBulk([]byte("endpoint")), respBulk([]byte(host)),
+			respBulk([]byte("role")), respBulk([]byte("master")),
+			respBulk([]byte("replication-offset")), respInt(0),
+			respBulk([]byte("health")), respBulk([]byte("online")),
+		)
+		shards = append(shards, respMapOf(
+			respBulk([]byte("slots")), respArrayOf(slots...),
+			respBulk([]byte("nodes")), respArrayOf(node),
+		))
+	}
+	return respArrayOf(shards...)
+}
+
+// clusterNodes lists each proxy as Redis does:
+// id host:port@cport flags master-id ping-sent pong-recv epoch link-state slot ...
+func clusterNodes() string {
+
+	var lines []string
+	for i, addr := range slotNodes() {
+		host, port := splitAddr(addr)
+		flags := "master"
+		if addr == announceAddr {
+			flags = "myself,master"
+		}
+		line := fmt.Sprintf("%s %s:%d@%d %s - 0 0 %d connected", nodeID(addr), host, port, port+10000, flags, i+1)
+		for _, r := range servedSlots {
+			if r.addr != addr {
+				continue
+			}
+			if r.start == r.end {
+				line += fmt.Sprintf(" %d", r.start)
+			} else {
+				line += fmt.Sprintf(" %d-%d", r.start, r.end)
+			}
+		}
+		lines = append(lines, line+"\n")
+	}
+	return strings.Join(lines, "")
+}
+
+func clusterInfo() string {
+
+	assigned := 0
+	for _, r := range servedSlots {
+		assigned += r.end - r.start + 1
+	}
+	state := "ok"
+	if assigned < cluster.NumSlots {
+		state = "fail"
+	}
+	nodes := len(slotNodes())
+	return fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:0\r\ncluster_slots_fail:0\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\n",
+		state, assigned, assigned, nodes, nodes)
+}
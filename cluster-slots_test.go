@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+)
+
+func TestClusterSlotsCommands(t *testing.T) {
+
+	servedSlots = []slotRange{{0, 8191, "proxy-a:6379"}, {8192, 16383, "proxy-b:6379"}}
+	announceAddr = "proxy-a:6379"
+	defer func() { servedSlots, announceAddr = nil, "" }()
+
+	conn := dialTest(t)
+	defer conn.conn.Close()
+
+	expected := respArrayOf(
+		respArrayOf(respInt(0), respInt(8191), respArrayOf(respBulk([]byte("proxy-a")), respInt(6379), respBulk([]byte(nodeID("proxy-a:6379"))))),
+		respArrayOf(respInt(8192), respInt(16383), respArrayOf(respBulk([]byte("proxy-b")), respInt(6379), respBulk([]byte(nodeID("proxy-b:6379"))))),
+	)
+	if reply := conn.do(t, "CLUSTER", "SLOTS"); !reflect.DeepEqual(reply, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, reply))
+	}
+
+	reply := conn.do(t, "CLUSTER", "NODES")
+	lines := strings.Split(strings.TrimSuffix(string(reply.str), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "proxy-a:6379@16379 myself,master - 0 0 1 connected 0-8191") ||
+		!strings.HasSuffix(lines[1], "proxy-b:6379@16379 master - 0 0 2 connected 8192-16383") {
+		t.Errorf("Unexpected CLUSTER NODES: %q", reply.str)
+	}
+
+	reply = conn.do(t, "CLUSTER", "SHARDS")
+	if len(reply.elems) != 2 || len(reply.elems[1].elems) != 4 {
+		t.Fatalf("Unexpected CLUSTER SHARDS: %q", appendRESP(nil, reply))
+	}
+	if slots := reply.elems[1].elems[1]; !reflect.DeepEqual(slots, respArrayOf(respInt(8192), respInt(16383))) {
+		t.Errorf("Expected the slots 8192-16383. Got %q", appendRESP(nil, slots))
+	}
+
+	if reply := conn.do(t, "CLUSTER", "INFO"); !strings.Contains(string(reply.str), "cluster_state:ok\r\n") {
+		t.Errorf("Expected cluster_state:ok. Got %q", reply.str)
+	}
+	if reply := conn.do(t, "CLUSTER", "KEYSLOT", "d"); reply.num != int64(cluster.Slot("d")) {
+		t.Errorf("Expected slot %d. Got %q", cluster.Slot("d"), appendRESP(nil, reply))
+	}
+
+	// Keys ('d') served by the other proxy are redirected, for reads and writes
+	moved := fmt.Sprintf("MOVED %d proxy-b:6379", cluster.Slot("d"))
+	for _, args := range [][]string{{"GET", "d"}, {"MGET", "{d}x", "d"}, {"HGET", "d", "field"}, {"SET", "d", "value"}} {
+		if reply := conn.do(t, args...); reply.kind != respError || string(reply.str) != moved {
+			t.Errorf("Expected '%s' for %q. Got %q", moved, args, appendRESP(nil, reply))
+		}
+	}
+	for _, args := range [][]string{{"GET", "b"}, {"PING"}, {"READONLY"}} {
+		if reply := conn.do(t, args...); reply.kind == respError {
+			t.Errorf("Expected %q to be served. Got %q", args, appendRESP(nil, reply))
+		}
+	}
+
+	// With part of the keyspace unserved, so is the cluster
+	servedSlots = servedSlots[:1]
+	if reply := conn.do(t, "GET", "d"); string(reply.str) != "CLUSTERDOWN Hash slot not served" {
+		t.Errorf("Expected 'CLUSTERDOWN Hash slot not served'. Got %q", appendRESP(nil, reply))
+	}
+	if reply := conn.do(t, "CLUSTER", "INFO"); !strings.Contains(string(reply.str), "cluster_state:fail\r\n") {
+		t.Errorf("Expected cluster_state:fail. Got %q", reply.str)
+	}
+}
+
+func TestClusterSlotsTier(t *testing.T) {
+
+	// Two tiers, each serving half of the slots
+	slots := "CLUSTER_SLOTS=0-8191=127.0.0.1:7004,8192-16383=127.0.0.1:7005"
+	stopA := startTier(t, testRedisAddr, "7004", "tcp", slots, "CLUSTER_ANNOUNCE=127.0.0.1:7004")
+	defer stopA()
+	stopB := startTier(t, testRedisAddr, "7005", "tcp", slots, "CLUSTER_ANNOUNCE=127.0.0.1:7005")
+	defer stopB()
+
+	redisPool.Cmd("SET", "b", "valueB")
+	redisPool.Cmd("SET", "d", "valueD")
+	defer redisPool.Cmd("DEL", "b", "d")
+
+	// A cluster-aware client finds each key's tier
+	c, err := createCluster("127.0.0.1:7004", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for key, expected := range map[string]string{"b": "valueB", "d": "valueD"} {
+		if val, err := c.Cmd("GET", key).Str(); val != expected || err != nil {
+			t.Errorf("Expected '%s'. Got '%s' and %v", expected, val, err)
+		}
+	}
+	if addr := c.GetAddrForKey("d"); addr != "127.0.0.1:7005" {
+		t.Errorf("Expected 'd' to be served by '127.0.0.1:7005'. Got '%s'", addr)
+	}
+
+	// While a plain client is redirected
+	client, err := createRedisClient("127.0.0.1:7004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Cmd("GET", "d").Err; err == nil || !strings.HasPrefix(err.Error(), "MOVED ") {
+		t.Errorf("Expected a MOVED error. Got %v", err)
+	}
+
+	// And keys in different slots are rejected by either tier, before any redirect
+	for _, addr := range []string{"127.0.0.1:7004", "127.0.0.1:7005"} {
+		tier, err := createRedisClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tier.Close()
+		for _, cmd := range [][]interface{}{{"MGET", "b", "d"}, {"DEL", "d", "b"}} {
+			err := tier.Cmd(cmd[0].(string), cmd[1:]...).Err
+			if err == nil || !strings.HasPrefix(err.Error(), "CROSSSLOT ") {
+				t.Errorf("Expected a CROSSSLOT error for %v from %s. Got %v", cmd, addr, err)
+			}
+		}
+	}
+	if val, err := client.Cmd("MGET", "{b}x", "b").List(); err != nil || len(val) != 2 || val[1] != "valueB" {
+		t.Errorf("Expected keys in the same slot to be served. Got %v and %v", val, err)
+	}
+}
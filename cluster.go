@@ -0,0 +1,410 @@
+// cluster handles caching in front of a Redis Cluster, routing each command to the node serving its key.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// The upstream Redis Cluster, if the upstream is one. It is connected to
+// in the background, as the first node may not be up yet (in the meantime
+// cached values are served, and the proxy reported as degraded).
+var redisCluster *cluster.Cluster
+var clusterConnecting bool
+var clusterLock sync.RWMutex
+
+var errClusterConnecting = errors.New("Redis Cluster not connected to yet")
+
+// The slot map is fetched again (when commands are redirected) at most this often
+var slotsRefreshThrottle = 500 * time.Millisecond
+
+// createCluster fetches the slot map from the node, logging whenever it
+// changes (which the vendored client finds as commands are redirected).
+func createCluster(addr string, size int) (*cluster.Cluster, error) {
+
+	c, err := cluster.NewWithOpts(cluster.Opts{
+		Addr:          addr,
+		PoolSize:      size,
+		ResetThrottle: slotsRefreshThrottle,
+		Dialer:        upstreamDialer(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range c.ChangeCh {
+			log.Println("Redis Cluster topology changed, slot map refreshed")
+		}
+	}()
+	return c, nil
+}
+
+// startCluster connects to the Redis Cluster through the node.
+func startCluster(addr string, size int) {
+
+	clusterLock.Lock()
+	clusterConnecting = true
+	clusterLock.Unlock()
+
+	go func() {
+		c := connectCluster(addr, size)
+		clusterLock.Lock()
+		redisCluster, clusterConnecting = c, false
+		clusterLock.Unlock()
+	}()
+}
+
+// currentCluster returns the Redis Cluster client (nil until connected),
+// and whether the upstream is a Redis Cluster.
+func currentCluster() (*cluster.Cluster, bool) {
+
+	clusterLock.RLock()
+	defer clusterLock.RUnlock()
+
+	return redisCluster, redisCluster != nil || clusterConnecting
+}
+
+func stopCluster() {
+
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+
+	if redisCluster != nil {
+		redisCluster.Close()
+	}
+	redisCluster, clusterConnecting = nil, false
+}
+
+// connectCluster creates the cluster client, retrying (with backoff)
+// until the node can be reached.
+func connectCluster(addr string, size int) *cluster.Cluster {
+
+	for retry := 0; ; retry++ {
+		c, err := createCluster(addr, size)
+		if err == nil {
+			noteUpstream(true)
+			return c
+		}
+		log.Printf("Error on Redis Cluster connection to '%s' error: %s\n", addr, err)
+		noteUpstream(false)
+		time.Sleep(backoff(resubscribeDelay, retry))
+	}
+}
+
+// clusterFetch pipelines the commands for each node to it, all at once.
+func (p *upstreamPipeline) clusterFetch(c *cluster.Cluster) ([]respValue, bool) {
+
+	return p.fanOutFetch(func(cmds []upstreamCmd) ([]respValue, bool) {
+		split := upstreamPipeline{cmds: cmds}
+		return split.splitFetch(c.GetAddrForKey, func(key string, cmds []nodeCmd) ([]respValue, bool) {
+			return fetchFromNode(c, key, cmds)
+		})
+	}, func(cmd upstreamCmd) (respValue, bool) {
+		return fetchFromEveryNode(c, cmd)
+	})
+}
+
+// The key used to route commands without keys (as the vendored client
+// takes an empty key to mean an unknown node, for which it leaks a pool)
+const anyKey = "any"
+
+// errCrossSlot is returned for commands whose keys are served by different
+// nodes (and which can't be split into a command per key).
+var errCrossSlot = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+
+// splitCommands are the multi-key commands split into a command per key
+// (or key and value), so that each can be sent to the node serving it.
+var splitCommands = map[string]struct {
+	cmd  string
+	step int
+}{
+	"MGET":   {"GET", 1},
+	"EXISTS": {"EXISTS", 1},
+	"DEL":    {"DEL", 1},
+	"UNLINK": {"UNLINK", 1},
+	"TOUCH":  {"TOUCH", 1},
+	"MSET":   {"SET", 2},
+}
+
+// fanOutCommands change every key, so are sent to every node.
+var fanOutCommands = map[string]bool{"FLUSHDB": true, "FLUSHALL": true, "SWAPDB": true}
+
+// keyspaceReads read every key, so would only cover the one node they
+// were sent to, and are refused instead.
+var keyspaceReads = map[string]bool{"DBSIZE": true, "KEYS": true, "SCAN": true, "RANDOMKEY": true}
+
+// fanOutFetch sends the commands with fetch, other than those changing
+// every key, which are sent to every node with fetchEvery (once those
+// before them have completed, and before those after them are sent).
+func (p *upstreamPipeline) fanOutFetch(fetch func(cmds []upstreamCmd) ([]respValue, bool), fetchEvery func(c upstreamCmd) (respValue, bool)) ([]respValue, bool) {
+
+	resps := make([]respValue, len(p.cmds))
+	sent := false
+
+	// Sends the commands from start up to end
+	start := 0
+	fetchTo := func(end int) {
+		var cmds []upstreamCmd
+		var fetched []int
+		for i := start; i < end; i++ {
+			if name := strings.ToUpper(p.cmds[i].cmd); keyspaceReads[name] {
+				resps[i] = respErr(fmt.Sprintf("ERR '%s' would only cover one node, so is not supported through this proxy", strings.ToLower(name)))
+				continue
+			}
+			cmds = append(cmds, p.cmds[i])
+			fetched = append(fetched, i)
+		}
+		if len(cmds) > 0 {
+			fetchedResps, fetchedSent := fetch(cmds)
+			for j, i := range fetched {
+				resps[i] = fetchedResps[j]
+			}
+			sent = sent || fetchedSent
+		}
+		start = end
+	}
+
+	for i, c := range p.cmds {
+		if fanOutCommands[strings.ToUpper(c.cmd)] {
+			fetchTo(i)
+			var everySent bool
+			resps[i], everySent = fetchEvery(c)
+			sent = sent || everySent
+			start = i + 1
+		}
+	}
+	fetchTo(len(p.cmds))
+	return resps, sent
+}
+
+// joinEvery joins the replies of every node to a command: the first
+// error, if any, or else the first reply.
+func joinEvery(resps []respValue) respValue {
+
+	for _, resp := range resps {
+		if resp.isError() {
+			return resp
+		}
+	}
+	return resps[0]
+}
+
+// nodeCmd is one of the commands (or, for split commands, one of its
+// keys) pipelined to a node.
+type nodeCmd struct {
+	cmd  string
+	args []interface{}
+	i    int // of the command in the pipeline
+	elem int // of the key in a split command (otherwise -1)
+}
+
+func upstreamCmds(cmds []nodeCmd) []upstreamCmd {
+
+	upstream := make([]upstreamCmd, len(cmds))
+	for j, c := range cmds {
+		upstream[j] = upstreamCmd{cmd: c.cmd, args: c.args}
+	}
+	return upstream
+}
+
+// splitFetch pipelines the commands for each node (as nodeFor finds from
+// their keys) to it with fetchFrom, all at once, splitting multi-key
+// commands and joining their replies. It also returns whether any of the
+// commands were sent.
+func (p *upstreamPipeline) splitFetch(nodeFor func(key string) string, fetchFrom func(key string, cmds []nodeCmd) ([]respValue, bool)) ([]respValue, bool) {
+
+	resps := make([]respValue, len(p.cmds))
+
+	// The commands for each node, and a key served by the node
+	nodes := make(map[string][]nodeCmd)
+	keys := make(map[string]string)
+	route := func(key string, c nodeCmd) {
+		key = routingKey(key)
+		node := nodeFor(key)
+		nodes[node] = append(nodes[node], c)
+		keys[node] = key
+	}
+
+	splits := make(map[int][]respValue)
+	for i, c := range p.cmds {
+		split, ok := splitCommands[strings.ToUpper(c.cmd)]
+		if ok && len(c.args) > 0 && len(c.args)%split.step == 0 {
+			splits[i] = make([]respValue, len(c.args)/split.step)
+			for elem := range splits[i] {
+				args := c.args[elem*split.step : (elem+1)*split.step]
+				k, _ := redis.KeyFromArgs(args...)
+				route(k, nodeCmd{split.cmd, args, i, elem})
+			}
+			continue
+		}
+		// Commands with keys served by different nodes are sent to none
+		cmdKeys := commandKeys(c)
+		node := nodeFor(routingKey(cmdKeys[0]))
+		for _, k := range cmdKeys[1:] {
+			if nodeFor(routingKey(k)) != node {
+				resps[i] = respErr(errCrossSlot.Error())
+			}
+		}
+		if !resps[i].isError() {
+			route(cmdKeys[0], nodeCmd{c.cmd, c.args, i, -1})
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sent := false
+	for node, cmds := range nodes {
+		wg.Add(1)
+		go func(key string, cmds []nodeCmd) {
+			defer wg.Done()
+
+			nodeResps, nodeSent := fetchFrom(key, cmds)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			sent = sent || nodeSent
+			for j, c := range cmds {
+				if c.elem < 0 {
+					resps[c.i] = nodeResps[j]
+				} else {
+					splits[c.i][c.elem] = nodeResps[j]
+				}
+			}
+		}(keys[node], cmds)
+	}
+	wg.Wait()
+
+	for i, elems := range splits {
+		resps[i] = joinReplies(strings.ToUpper(p.cmds[i].cmd), elems)
+	}
+	return resps, sent
+}
+
+// routingKey returns the key to route by; commands without keys (such as
+// PING) go to any node.
+func routingKey(key string) string {
+
+	if key == "" {
+		return anyKey
+	}
+	return key
+}
+
+// commandKeys returns the keys of the command: those it writes, or else
+// its first argument (which may not be a key, but is routed as one).
+func commandKeys(c upstreamCmd) []string {
+
+	args := make([][]byte, len(c.args)+1)
+	args[0] = []byte(c.cmd)
+	for i, arg := range c.args {
+		k, _ := redis.KeyFromArgs(arg)
+		args[i+1] = []byte(k)
+	}
+	if keys, _ := writtenKeys(args); len(keys) > 0 {
+		return keys
+	}
+	k, _ := redis.KeyFromArgs(c.args...)
+	return []string{k}
+}
+
+// joinReplies joins the replies to the commands a multi-key command was
+// split into; any error (but for MGET, only a connection error) fails it.
+func joinReplies(name string, elems []respValue) respValue {
+
+	for _, elem := range elems {
+		if elem.err != nil || name != "MGET" && elem.isError() {
+			return elem
+		}
+	}
+	switch name {
+	case "MGET":
+		return respArrayOf(elems...)
+	case "MSET":
+		return respSimple("OK")
+	}
+	var n int64
+	for _, elem := range elems {
+		n += elem.num
+	}
+	return respInt(n)
+}
+
+// fetchFromNode pipelines the commands to the node serving the key. Any
+// redirected (as the slots have moved) are then sent again on their own,
+// following the redirect and refreshing the slot map.
+func fetchFromNode(rc *cluster.Cluster, key string, cmds []nodeCmd) ([]respValue, bool) {
+
+	client, err := rc.GetForKey(key)
+	if err != nil {
+		return unavailable(err, len(cmds)), false
+	}
+
+	resps := roundTrip(client, upstreamCmds(cmds))
+	if client.LastCritical != nil {
+		// The node may have failed over, so fetch the slot map before retrying
+		rc.Reset()
+	}
+	rc.Put(client)
+
+	for j, c := range cmds {
+		if redirected(resps[j]) {
+			resps[j] = followRedirect(rc, c, resps[j])
+		}
+	}
+	return resps, true
+}
+
+// followRedirect sends a redirected command again. If it was MOVED, the
+// slot map is refreshed and it is sent to its new node as before; if it
+// is still (or was ASK) redirected, the cluster client follows the
+// redirect itself (reading the reply as RESP2).
+func followRedirect(rc *cluster.Cluster, c nodeCmd, reply respValue) respValue {
+
+	if strings.HasPrefix(string(reply.str), "MOVED ") {
+		rc.Reset()
+		cmd := upstreamCmd{cmd: c.cmd, args: c.args}
+		if client, err := rc.GetForKey(routingKey(commandKeys(cmd)[0])); err == nil {
+			reply = roundTrip(client, []upstreamCmd{cmd})[0]
+			rc.Put(client)
+			if !redirected(reply) {
+				return reply
+			}
+		}
+	}
+	return respFromRadix(rc.Cmd(c.cmd, c.args...))
+}
+
+// fetchFromEveryNode sends the command to every master.
+func fetchFromEveryNode(rc *cluster.Cluster, c upstreamCmd) (respValue, bool) {
+
+	clients, err := rc.GetEvery()
+	if err != nil {
+		return respUnavailable(err), false
+	}
+	var resps []respValue
+	for _, client := range clients {
+		resps = append(resps, roundTrip(client, []upstreamCmd{c})[0])
+		rc.Put(client)
+	}
+	if len(resps) == 0 {
+		return respUnavailable(errors.New("no Redis Cluster nodes known")), false
+	}
+	return joinEvery(resps), true
+}
+
+func redirected(resp respValue) bool {
+
+	if !resp.isError() || resp.err != nil {
+		return false
+	}
+	msg := string(resp.str)
+	return strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+)
+
+// standInCluster is a stand-in Redis Cluster of two nodes, where either
+// each serves half of the slots, or (once moved) the second serves all.
+type standInCluster struct {
+	nodes [2]*standIn
+	addrs [2]string
+	moved bool
+	lock  sync.Mutex
+}
+
+func startStandInCluster(t *testing.T) *standInCluster {
+
+	c := &standInCluster{}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for n := range c.nodes {
+		node := n
+		c.nodes[n] = startStandIn(t, func(args [][]byte) []respValue {
+			return c.serve(node, args)
+		})
+		c.addrs[n] = c.nodes[n].addr()
+	}
+	return c
+}
+
+// owner returns the node serving the slot.
+func (c *standInCluster) owner(slot uint16) int {
+
+	if c.moved || slot >= cluster.NumSlots/2 {
+		return 1
+	}
+	return 0
+}
+
+func (c *standInCluster) serve(node int, args [][]byte) []respValue {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch strings.ToUpper(string(args[0])) {
+	case "CLUSTER":
+		var slots []respValue
+		for n, addr := range c.addrs {
+			host, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.Atoi(port)
+			start, end := int64(n*cluster.NumSlots/2), int64((n+1)*cluster.NumSlots/2-1)
+			if c.moved {
+				if n == 0 {
+					continue
+				}
+				start = 0
+			}
+			slots = append(slots, respArrayOf(respInt(start), respInt(end), respArrayOf(respBulk([]byte(host)), respInt(int64(p)))))
+		}
+		return []respValue{respArrayOf(slots...)}
+	case "GET":
+		slot := cluster.Slot(string(args[1]))
+		if owner := c.owner(slot); owner != node {
+			return []respValue{respErr("MOVED " + strconv.Itoa(int(slot)) + " " + c.addrs[owner])}
+		}
+		return []respValue{respBulk([]byte("node" + strconv.Itoa(node) + ":" + string(args[1])))}
+	case "PING":
+		return []respValue{respSimple("PONG")}
+	case "FLUSHDB":
+		return []respValue{respSimple("OK")}
+	}
+	return []respValue{respErr("ERR unknown command")}
+}
+
+func (c *standInCluster) close() {
+
+	for _, node := range c.nodes {
+		node.close()
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	throttle := slotsRefreshThrottle
+	slotsRefreshThrottle = time.Millisecond
+	defer func() { slotsRefreshThrottle = throttle }()
+
+	standIns := startStandInCluster(t)
+	defer standIns.close()
+
+	c, err := createCluster(standIns.addrs[0], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterLock.Lock()
+	redisCluster = c
+	clusterLock.Unlock()
+	defer stopCluster()
+
+	// Keys 'b' and 'c' hash to the first half of the slots, 'd' to the second
+	owners := map[string]int{"b": 0, "c": 0, "d": 1}
+	for key, owner := range owners {
+		if n := standIns.owner(cluster.Slot(key)); n != owner {
+			t.Fatalf("Expected '%s' to be served by node %d. Got %d", key, owner, n)
+		}
+	}
+
+	vals, errs := getRedisMultiValues([]string{"b", "c", "d"})
+	for i, expected := range []string{"node0:b", "node0:c", "node1:d"} {
+		if vals[i] != expected || errs[i] != nil {
+			t.Errorf("Expected '%s'. Got '%s' and %v", expected, vals[i], errs[i])
+		}
+	}
+	if buf := sendTCP(t, "GET d\r\nPING\r\n"+quitRequest); string(buf) != "$7\r\nnode1:d\r\n+PONG\r\n+OK\r\n" {
+		t.Errorf("Expected '$7\\r\\nnode1:d\\r\\n+PONG\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+
+	// Commands changing every key reach every node
+	if buf := sendTCP(t, "FLUSHDB\r\n"+quitRequest); string(buf) != "+OK\r\n+OK\r\n" {
+		t.Errorf("Expected '+OK\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+	for _, node := range standIns.nodes {
+		node.waitFor(t, "FLUSHDB")
+	}
+
+	// Once the slots move, the redirects are followed (and the slot map refreshed)
+	standIns.lock.Lock()
+	standIns.moved = true
+	standIns.lock.Unlock()
+	redisCache.lru.Purge()
+	time.Sleep(2 * slotsRefreshThrottle)
+
+	vals, errs = getRedisMultiValues([]string{"b", "c", "d"})
+	for i, expected := range []string{"node1:b", "node1:c", "node1:d"} {
+		if vals[i] != expected || errs[i] != nil {
+			t.Errorf("Expected '%s'. Got '%s' and %v", expected, vals[i], errs[i])
+		}
+	}
+	if addr := c.GetAddrForKey("b"); addr != standIns.addrs[1] {
+		t.Errorf("Expected 'b' to be mapped to '%s'. Got '%s'", standIns.addrs[1], addr)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestClusterConnecting(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	delay := resubscribeDelay
+	resubscribeDelay = 10 * time.Millisecond
+	defer func() { resubscribeDelay = delay }()
+
+	// The node to connect through isn't up yet
+	standIns := startStandInCluster(t)
+	defer standIns.close()
+	addr := standIns.addrs[0]
+	standIns.nodes[0].close()
+
+	startCluster(addr, 2)
+	defer stopCluster()
+
+	// Meanwhile the proxy is degraded
+	if buf := sendTCP(t, "GET d\r\n"+quitRequest); string(buf) != "-ERR upstream unavailable\r\n+OK\r\n" {
+		t.Errorf("Expected '-ERR upstream unavailable\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	if response := executeRequest(req); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected DEGRADED. Got %d '%s'", response.Code, response.Body.String())
+	}
+
+	// Until it is connected to
+	standIns.nodes[0] = startStandInAt(t, addr, func(args [][]byte) []respValue {
+		return standIns.serve(0, args)
+	})
+	timeout := time.After(5 * time.Second)
+	for {
+		if response := executeRequest(req); response.Code == http.StatusOK {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("Expected the proxy to connect to the cluster")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if buf := sendTCP(t, "GET d\r\n"+quitRequest); string(buf) != "$7\r\nnode1:d\r\n+OK\r\n" {
+		t.Errorf("Expected '$7\\r\\nnode1:d\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
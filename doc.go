@@ -1,20 +1,99 @@
 /*
 redis-cache is a composable redis caching proxy.
 
-Specifically, it caches Redis GET requests, ideally off-loading processing from the Redis master.
+Specifically, it caches Redis GET (and MGET) requests, ideally off-loading processing from the Redis master.
+Over TCP, the replies to common hash, list, set and sorted set reads (HGET, HGETALL, LRANGE, SMEMBERS,
+ZRANGE and so on) are cached too, while any other commands are passed through to the Redis master.
+Concurrent cache misses for the same reply share a single upstream fetch; over HTTP, the number of
+requests collapsed this way is published (as collapsedRequests) at /debug/vars.
+Lost connections to the Redis master are reopened as needed, so tiers recover as those above them restart;
+until then, /ping reports DEGRADED (with a 503) while cached values are still served.
+As with Redis, inline commands (such as 'echo "GET keyt" | nc localhost 6379') are accepted too.
 
 These caching proxies can be stacked to add capacity to a Redis master while reducing load.
+Each TCP tier also serves Redis 6 broadcast tracking (CLIENT TRACKING ON REDIRECT id BCAST), so
+with CLIENT_TRACKING set the tiers below it drop keys as soon as they are invalidated above.
+Clients which negotiate RESP3 (HELLO 3) can also use CLIENT TRACKING ON to be pushed invalidations
+for the keys they have read. A client which falls 1000 invalidations behind is disconnected.
 
 Environmental parameters:
 
-    REDIS specifies the backing Redis master (which might be another caching proxy)
+    REDIS specifies the backing Redis master (which might be another caching proxy), optionally followed by
+    read replicas, for example 'primary=redis-master:6379,replica=redis-zone-a:6379'; cache misses are read
+    from the healthy replicas (checked every second), or else the master, while other commands go to the master;
+    as the replicas may lag, misses for keys written through the proxy in the last second are read from the master
 
-    EXPIRY_TIME specifies the number of milliseconds Redis values should be cached
+    SENTINEL optionally lists (comma-separated) the Redis Sentinels to find the master from instead of REDIS,
+    following it as it fails over
+
+    SENTINEL_MASTER specifies the name the sentinels monitor the master under (by default, mymaster)
+
+    SENTINEL_FLUSH specifies whether to flush the cache when the master fails over (true) or not (false)
+
+    CLUSTER specifies whether REDIS is a node of a Redis Cluster (true), whose other nodes are then found
+    from it, or not (false); misses are sent to the nodes serving their keys, following any redirects, while
+    FLUSHDB, FLUSHALL and SWAPDB are sent to every master, and commands reading every key (DBSIZE, KEYS,
+    SCAN and RANDOMKEY) are refused, as they would only cover one master (the same goes for SHARDS); the proxy
+    starts serving before REDIS can be reached, reporting DEGRADED until it has connected to the cluster
+
+    SHARDS optionally lists (comma-separated) independent Redis masters to shard keys across instead of REDIS,
+    each optionally followed by its weight (for example 'redis-a:6379,redis-b:6379*2'); keys are placed on a
+    consistent-hash ring (by any {hash tag}, as with Redis Cluster), so adding a master only moves a fraction of
+    them, and multi-key commands such as MGET, DEL and MSET are split across the masters
+
+    SHARD_VNODES specifies the number of points each SHARDS master has on the ring per unit of weight (by default, 160)
+
+    PEERS optionally lists (comma-separated) the TCP addresses of sibling proxies (including this one) which share
+    the keys between them on a consistent-hash ring, each filling misses for keys it doesn't own from the peer which
+    does (or, if it can't be reached, REDIS), so that a tier fetches each key from REDIS once; the misses filled
+    this way are published (as peerFills) at /debug/vars, and writes through a proxy evict their keys from the
+    peers owning them, in batches sent after the writes (evicting every key if 1000 writes are waiting); peers
+    connect with the name redis-cache-peer, which clients should not give themselves
+
+    PEERS_DNS optionally specifies a name (host:port) the peers are also found from, looked up every 5 seconds (for
+    example, a headless service)
+
+    PEER_SELF specifies this proxy's address among the peers (by default, that with one of its own addresses and PORT)
+
+    CLUSTER_SLOTS optionally presents a tier of TCP proxies to (cluster-aware) clients as a Redis Cluster, listing the
+    slot ranges each proxy serves, for example '0-8191=proxy-a:6379,8192-16383=proxy-b:6379'; the proxies answer
+    CLUSTER SLOTS, CLUSTER SHARDS and CLUSTER NODES with it, and redirect (MOVED) reads and writes of keys served by another
+    proxy, rejecting (CROSSSLOT) those of keys in different slots
+
+    CLUSTER_ANNOUNCE specifies this proxy's address in CLUSTER_SLOTS
+
+    EXPIRY_TIME specifies the number of milliseconds Redis values should be cached; the TTL of each key is fetched
+    with its value, so values are only cached until their keys expire upstream (and PTTL and TTL of cached keys are
+    answered with the time left, passing it down to the tiers below)
 
     CACHE_SIZE defines the number of Redis values to cache
 
+    POOL_SIZE defines the number of idle connections to REDIS to keep open (more are opened as needed)
+
+    UPSTREAM_RETRIES specifies the number of times a request failing to reach REDIS is retried (with exponential
+    backoff) before an error is returned; commands passed through are only retried if they weren't sent
+
     PORT specifies the port on which the caching instance should listen
 
     TYPE specifies the type of caching to provide (either HTTP or TCP)
+
+    IDLE_TIMEOUT specifies the number of milliseconds after which idle TCP client connections are closed (0 means never)
+
+    FORWARD_ALLOW optionally limits the uncached commands forwarded to REDIS to this comma-separated list
+
+    FORWARD_DENY lists uncached commands which are never forwarded to REDIS (for example FLUSHALL,CONFIG)
+
+    UPDATE_ON_WRITE specifies whether SETs passing through update cached values (true) or just evict them (false)
+
+    KEYSPACE_NOTIFICATIONS specifies whether to evict cached keys on REDIS keyspace notifications (true) or not (false);
+    REDIS must be configured to send them (for example with 'CONFIG SET notify-keyspace-events KA')
+
+    CLIENT_TRACKING specifies whether to evict cached keys on REDIS (6.0 or later) client-side caching invalidations (true) or not (false)
+
+    TRACKING_PREFIXES optionally limits the keys tracked to those starting with this comma-separated list of prefixes
+
+    UPSTREAM_PROTOCOL specifies the RESP protocol version (2 or 3) spoken to REDIS; replies are cached as REDIS
+    sent them and translated for each client, which may negotiate RESP3 with HELLO 3. So RESP3 clients are only
+    sent maps, sets, doubles and the like when REDIS speaks RESP3 too (otherwise they are sent RESP2 replies)
 */
 package main
@@ -0,0 +1,436 @@
+// downstream handles the downstream client connections, including their tracking of invalidations.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// clientConn is a TCP client connection. Invalidations may also be pushed
+// to it from other connections, so all writes go through send.
+type clientConn struct {
+	id         int64
+	proto      int // RESP protocol version, as negotiated with HELLO (guarded by lock)
+	w          *bufio.Writer
+	lock       sync.Mutex
+	subscribed bool // to invalidation messages (guarded by downstreamLock)
+	name       string
+
+	// Invalidations are queued for a single writer, so a client too slow
+	// to read them holds up no one else (guarded by downstreamLock)
+	pushes  chan respValue
+	conn    io.Closer // closed to drop the client, if its queue overflows
+	dropped bool
+}
+
+// As with the Redis client output buffer limit, a client with this
+// many invalidations still to be written is disconnected
+const maxQueuedPushes = 1000
+
+var lastClientID int64
+
+func newClientConn(w io.Writer) *clientConn {
+
+	c := &clientConn{id: atomic.AddInt64(&lastClientID, 1), proto: 2, w: bufio.NewWriter(w)}
+	c.pushes = make(chan respValue, maxQueuedPushes)
+	c.conn, _ = w.(io.Closer)
+	return c
+}
+
+// send writes the replies to the client, in its protocol version.
+func (c *clientConn) send(replies ...respValue) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, reply := range replies {
+		if c.proto == 3 {
+			writeRESP(c.w, toRESP3(reply))
+		} else {
+			writeRESP(c.w, toRESP2(reply))
+		}
+	}
+	return c.w.Flush()
+}
+
+// register makes the client a possible target for invalidations.
+func (c *clientConn) register() {
+
+	downstreamLock.Lock()
+	defer downstreamLock.Unlock()
+
+	clients[c.id] = c
+	go c.writePushes()
+}
+
+// close stops any invalidations to (or tracking by) the client.
+func (c *clientConn) close() {
+
+	downstreamLock.Lock()
+	defer downstreamLock.Unlock()
+
+	if clients[c.id] == c {
+		close(c.pushes)
+	}
+	delete(clients, c.id)
+	delete(trackers, c.id)
+}
+
+// writePushes writes the client's queued invalidations until it closes.
+func (c *clientConn) writePushes() {
+
+	for msg := range c.pushes {
+		// The client's own connection closes it if this fails
+		c.send(msg)
+	}
+}
+
+// push queues an invalidation for the client, dropping the client if its
+// queue is full. It is called with downstreamLock held.
+func (c *clientConn) push(msg respValue) {
+
+	if c.dropped {
+		return
+	}
+	select {
+	case c.pushes <- msg:
+	default:
+		log.Printf("Dropping client %d, with %d invalidations unread\n", c.id, maxQueuedPushes)
+		c.dropped = true
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// As with Redis 6 client-side caching, a tracking client is sent the
+// invalidations for the keys it has read or, in broadcasting mode, for
+// all keys with the given prefixes. They are pushed to the client itself
+// (over RESP3) or sent to another connection subscribed to them.
+type tracker struct {
+	redirect int64 // 0 for the client itself
+	bcast    bool
+	prefixes []string
+}
+
+var clients = make(map[int64]*clientConn)
+var trackers = make(map[int64]tracker)
+
+// The clients (not broadcasting) which have read each key since it was last invalidated
+var trackedKeys = make(map[string]map[int64]bool)
+var downstreamLock sync.Mutex
+
+// readCommands maps the read commands (other than those cached) which may
+// be forwarded upstream to the keys they read, so that, as with Redis,
+// clients tracking the keys are sent invalidations for them.
+var readCommands = map[string]keySpec{
+	// Keys
+	"EXISTS": allKeys, "TYPE": firstKey, "TTL": firstKey, "PTTL": firstKey,
+	"EXPIRETIME": firstKey, "PEXPIRETIME": firstKey, "DUMP": firstKey,
+
+	// Strings
+	"GET": firstKey, "MGET": allKeys, "STRLEN": firstKey, "GETRANGE": firstKey, "SUBSTR": firstKey,
+	"GETBIT": firstKey, "BITCOUNT": firstKey, "BITPOS": firstKey, "PFCOUNT": allKeys, "LCS": twoKeys,
+
+	// Hashes
+	"HGET": firstKey, "HMGET": firstKey, "HGETALL": firstKey, "HKEYS": firstKey, "HVALS": firstKey,
+	"HLEN": firstKey, "HEXISTS": firstKey, "HSTRLEN": firstKey, "HRANDFIELD": firstKey, "HSCAN": firstKey,
+
+	// Lists
+	"LRANGE": firstKey, "LLEN": firstKey, "LINDEX": firstKey, "LPOS": firstKey,
+
+	// Sets
+	"SMEMBERS": firstKey, "SISMEMBER": firstKey, "SMISMEMBER": firstKey, "SCARD": firstKey,
+	"SRANDMEMBER": firstKey, "SSCAN": firstKey, "SINTER": allKeys, "SUNION": allKeys, "SDIFF": allKeys,
+
+	// Sorted sets
+	"ZRANGE": firstKey, "ZRANGEBYSCORE": firstKey, "ZRANGEBYLEX": firstKey,
+	"ZREVRANGE": firstKey, "ZREVRANGEBYSCORE": firstKey, "ZREVRANGEBYLEX": firstKey,
+	"ZSCORE": firstKey, "ZMSCORE": firstKey, "ZCARD": firstKey, "ZCOUNT": firstKey, "ZLEXCOUNT": firstKey,
+	"ZRANK": firstKey, "ZREVRANK": firstKey, "ZRANDMEMBER": firstKey, "ZSCAN": firstKey,
+
+	// Geo and streams
+	"GEOPOS": firstKey, "GEODIST": firstKey, "GEOHASH": firstKey, "GEORADIUS_RO": firstKey,
+	"GEORADIUSBYMEMBER_RO": firstKey, "GEOSEARCH": firstKey,
+	"XRANGE": firstKey, "XREVRANGE": firstKey, "XLEN": firstKey,
+}
+
+// readKeys returns the keys read by the command, if it is a read.
+func readKeys(args [][]byte) []string {
+
+	spec, ok := readCommands[strings.ToUpper(string(args[0]))]
+	if !ok {
+		return nil
+	}
+	return spec.keys(args)
+}
+
+// track notes that the client has read the keys, if it is tracking them.
+func (c *clientConn) track(keys ...string) {
+
+	downstreamLock.Lock()
+	defer downstreamLock.Unlock()
+
+	t, ok := trackers[c.id]
+	if !ok || t.bcast {
+		return
+	}
+	for _, key := range keys {
+		if trackedKeys[key] == nil {
+			trackedKeys[key] = make(map[int64]bool)
+		}
+		trackedKeys[key][c.id] = true
+	}
+}
+
+// hello handles HELLO [protover [AUTH username password] [SETNAME name]].
+func hello(c *clientConn, args [][]byte) respValue {
+
+	proto := c.proto
+	if len(args) > 1 {
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return respErr("ERR Protocol version is not an integer or out of range")
+		}
+		if n != 2 && n != 3 {
+			return respErr("NOPROTO unsupported protocol version")
+		}
+		proto = n
+	}
+	name := c.name
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			return respErr("ERR 'hello|auth' is not supported through this proxy")
+		case "SETNAME":
+			if i+1 == len(args) {
+				return respErr("ERR syntax error")
+			}
+			i++
+			name = string(args[i])
+		default:
+			return respErr("ERR syntax error")
+		}
+	}
+
+	c.lock.Lock()
+	c.proto = proto
+	c.lock.Unlock()
+	c.name = name
+
+	mode := "standalone"
+	if servedSlots != nil {
+		mode = "cluster"
+	}
+	return respMapOf(
+		respBulk([]byte("server")), respBulk([]byte("redis")),
+		respBulk([]byte("version")), respBulk([]byte("6.0.0")),
+		respBulk([]byte("proto")), respInt(int64(proto)),
+		respBulk([]byte("id")), respInt(c.id),
+		respBulk([]byte("mode")), respBulk([]byte(mode)),
+		respBulk([]byte("role")), respBulk([]byte("master")),
+		respBulk([]byte("modules")), respArrayOf(),
+	)
+}
+
+// serveClientCommand answers the CLIENT ID and CLIENT TRACKING commands
+// used by downstream clients (and tiers) to track invalidations, and
+// CLIENT SETNAME (used by peers) and CLIENT GETNAME.
+func serveClientCommand(c *clientConn, args [][]byte) respValue {
+
+	if len(args) < 2 {
+		return wrongArity(args)
+	}
+	switch strings.ToUpper(string(args[1])) {
+	case "ID":
+		return respInt(c.id)
+	case "SETNAME":
+		if len(args) != 3 {
+			return wrongArity(args)
+		}
+		c.name = string(args[2])
+		return respSimple("OK")
+	case "GETNAME":
+		if c.name == "" {
+			return respNil()
+		}
+		return respBulk([]byte(c.name))
+	case "TRACKING":
+		return clientTracking(c, args)
+	}
+	return respErr(fmt.Sprintf("ERR 'client|%s' is not supported through this proxy", strings.ToLower(errorArg(args[1]))))
+}
+
+// clientTracking handles CLIENT TRACKING ON|OFF [REDIRECT id] [BCAST] [PREFIX prefix ...].
+func clientTracking(c *clientConn, args [][]byte) respValue {
+
+	if len(args) < 3 {
+		return wrongArity(args)
+	}
+	switch strings.ToUpper(string(args[2])) {
+	case "OFF":
+		downstreamLock.Lock()
+		delete(trackers, c.id)
+		downstreamLock.Unlock()
+		return respSimple("OK")
+	case "ON":
+	default:
+		return respErr("ERR syntax error")
+	}
+
+	var t tracker
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BCAST":
+			t.bcast = true
+		case "REDIRECT", "PREFIX":
+			if i+1 == len(args) {
+				return respErr("ERR syntax error")
+			}
+			i++
+			if strings.ToUpper(string(args[i-1])) == "PREFIX" {
+				t.prefixes = append(t.prefixes, string(args[i]))
+				continue
+			}
+			id, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return respErr("ERR value is not an integer or out of range")
+			}
+			t.redirect = id
+		default:
+			return respErr("ERR syntax error")
+		}
+	}
+	if len(t.prefixes) > 0 && !t.bcast {
+		return respErr("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if t.redirect == c.id {
+		t.redirect = 0
+	}
+	if t.redirect == 0 && c.proto != 3 {
+		return respErr("ERR CLIENT TRACKING without REDIRECT requires RESP3 (HELLO 3)")
+	}
+
+	downstreamLock.Lock()
+	defer downstreamLock.Unlock()
+
+	if t.redirect != 0 && clients[t.redirect] == nil {
+		return respErr("ERR The client ID you want redirect to does not exist")
+	}
+	trackers[c.id] = t
+	return respSimple("OK")
+}
+
+// subscribe handles SUBSCRIBE, where only the invalidation channel is supported.
+func subscribe(c *clientConn, args [][]byte) respValue {
+
+	if len(args) != 2 || string(args[1]) != invalidateChannel {
+		return respErr(fmt.Sprintf("ERR only SUBSCRIBE %s is supported through this proxy", invalidateChannel))
+	}
+	downstreamLock.Lock()
+	c.subscribed = true
+	downstreamLock.Unlock()
+
+	reply := respArrayOf(respBulk([]byte("subscribe")), respBulk(args[1]), respInt(1))
+	if c.proto == 3 {
+		reply.kind = respPush
+	}
+	return reply
+}
+
+// subscribedCommand reports whether a subscribed RESP2 client may send
+// the command (which, as with Redis, is not the case for most commands).
+func subscribedCommand(name string) bool {
+
+	switch name {
+	case "SUBSCRIBE", "PING", "QUIT":
+		return true
+	}
+	return false
+}
+
+// broadcastInvalidation sends invalidations for the keys (or for all
+// keys) to the downstream clients tracking them.
+func broadcastInvalidation(keys []string, all bool) {
+
+	downstreamLock.Lock()
+	defer downstreamLock.Unlock()
+
+	// The keys each client is to be sent
+	sends := make(map[int64][]string)
+	for id, t := range trackers {
+		if t.bcast && !all {
+			for _, key := range keys {
+				if hasPrefix(key, t.prefixes) {
+					sends[id] = append(sends[id], key)
+				}
+			}
+		}
+	}
+	if all {
+		trackedKeys = make(map[string]map[int64]bool)
+	}
+	for _, key := range keys {
+		for id := range trackedKeys[key] {
+			sends[id] = append(sends[id], key)
+		}
+		delete(trackedKeys, key)
+	}
+
+	for id, t := range trackers {
+		if _, ok := sends[id]; !ok && !all {
+			continue
+		}
+
+		// A nil list of keys means all keys
+		payload := respValue{kind: respArray, null: true}
+		if !all {
+			elems := make([]respValue, len(sends[id]))
+			for i, key := range sends[id] {
+				elems[i] = respBulk([]byte(key))
+			}
+			payload = respArrayOf(elems...)
+		}
+
+		// As with Redis, invalidations are pushed to RESP3 clients
+		// (tracking clients themselves, or the connection they redirect
+		// to), or else published to the subscribed RESP2 connection
+		target := clients[id]
+		if t.redirect != 0 {
+			target = clients[t.redirect]
+		}
+		if target == nil {
+			continue
+		}
+		target.lock.Lock()
+		proto := target.proto
+		target.lock.Unlock()
+		msg := respPushOf(respBulk([]byte("invalidate")), payload)
+		if proto != 3 {
+			if !target.subscribed {
+				continue
+			}
+			msg = respPushOf(respBulk([]byte("message")), respBulk([]byte(invalidateChannel)), payload)
+		}
+		target.push(msg)
+	}
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConn is a client connection to a TCP handler.
+type testConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTest(t *testing.T) *testConn {
+
+	clientConn, serverConn := net.Pipe()
+	go handleRequest(serverConn)
+	return &testConn{clientConn, bufio.NewReader(clientConn)}
+}
+
+// do sends the command and returns the reply.
+func (c *testConn) do(t *testing.T, args ...string) respValue {
+
+	if _, err := c.conn.Write(appendRESP(nil, respCommand(args...))); err != nil {
+		t.Fatal(err)
+	}
+	return c.read(t)
+}
+
+func (c *testConn) read(t *testing.T) respValue {
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := readRESP(c.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestBroadcastInvalidation(t *testing.T) {
+
+	sub := dialTest(t)
+	defer sub.conn.Close()
+	tracker := dialTest(t)
+	defer tracker.conn.Close()
+
+	id := sub.do(t, "CLIENT", "ID")
+	if id.kind != respInteger {
+		t.Fatalf("Expected a client ID. Got %q", appendRESP(nil, id))
+	}
+	expected := respArrayOf(respBulk([]byte("subscribe")), respBulk([]byte(invalidateChannel)), respInt(1))
+	if reply := sub.do(t, "SUBSCRIBE", invalidateChannel); !reflect.DeepEqual(reply, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, reply))
+	}
+
+	// Subscribed clients can't read
+	if reply := sub.do(t, "GET", "key1"); reply.kind != respError || !strings.HasPrefix(string(reply.str), "ERR Can't execute 'get'") {
+		t.Errorf("Expected an error. Got %q", appendRESP(nil, reply))
+	}
+
+	// RESP2 clients must redirect, to a client which exists
+	if reply := tracker.do(t, "CLIENT", "TRACKING", "ON", "BCAST"); reply.kind != respError {
+		t.Errorf("Expected an error. Got %q", appendRESP(nil, reply))
+	}
+	if reply := tracker.do(t, "CLIENT", "TRACKING", "ON", "REDIRECT", "0", "BCAST"); reply.kind != respError {
+		t.Errorf("Expected an error. Got %q", appendRESP(nil, reply))
+	}
+	if reply := tracker.do(t, "CLIENT", "TRACKING", "ON", "REDIRECT", fmt.Sprint(id.num), "BCAST", "PREFIX", "key"); string(reply.str) != "OK" {
+		t.Fatalf("Expected '+OK'. Got %q", appendRESP(nil, reply))
+	}
+
+	// Only keys with the prefix are sent
+	invalidateKeys("other1", "key1")
+	expected = respArrayOf(respBulk([]byte("message")), respBulk([]byte(invalidateChannel)), respCommand("key1"))
+	if msg := sub.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+
+	invalidateAll()
+	expected = respArrayOf(respBulk([]byte("message")), respBulk([]byte(invalidateChannel)), respValue{kind: respArray, null: true})
+	if msg := sub.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+
+	// RESP3 connections are pushed invalidations instead, subscribed or not
+	redirect := dialTest(t)
+	defer redirect.conn.Close()
+	redirect.do(t, "HELLO", "3")
+	id = redirect.do(t, "CLIENT", "ID")
+	if reply := tracker.do(t, "CLIENT", "TRACKING", "ON", "REDIRECT", fmt.Sprint(id.num), "BCAST", "PREFIX", "key"); string(reply.str) != "OK" {
+		t.Fatalf("Expected '+OK'. Got %q", appendRESP(nil, reply))
+	}
+	invalidateKeys("key1")
+	expected = respPushOf(respBulk([]byte("invalidate")), respCommand("key1"))
+	if msg := redirect.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+
+	if reply := tracker.do(t, "CLIENT", "TRACKING", "OFF"); string(reply.str) != "OK" {
+		t.Errorf("Expected '+OK'. Got %q", appendRESP(nil, reply))
+	}
+}
+
+func TestSlowInvalidationClient(t *testing.T) {
+
+	slow := dialTest(t)
+	defer slow.conn.Close()
+	slow.do(t, "HELLO", "3")
+	if reply := slow.do(t, "CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "slow"); string(reply.str) != "OK" {
+		t.Fatalf("Expected '+OK'. Got %q", appendRESP(nil, reply))
+	}
+	trackers := downstreamTrackers()
+
+	// Invalidations queue up for a client not reading them, without
+	// holding up the writes making them, until the client is dropped
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < maxQueuedPushes+10; i++ {
+			invalidateKeys("slowkey")
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected invalidations not to wait for the client")
+	}
+
+	slow.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var err error
+	for err == nil {
+		_, err = readRESP(slow.r)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("Expected the client to be disconnected")
+	}
+	for i := 0; i < 100 && downstreamTrackers() == trackers; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if downstreamTrackers() != trackers-1 {
+		t.Errorf("Expected the client to stop tracking")
+	}
+}
+
+func TestInvalidationTiers(t *testing.T) {
+
+	// This process's TCP tier (port 5000) -> redis, with two
+	// tracking tiers stacked below it
+	stopMiddle := startTier(t, "localhost:5000", "7002", "tcp", "CLIENT_TRACKING=true")
+	defer stopMiddle()
+	for i := 0; i < 100 && downstreamTrackers() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopBottom := startTier(t, "localhost:7002", "7003", "tcp", "CLIENT_TRACKING=true")
+	defer stopBottom()
+	// Allow the bottom tier to start tracking the middle tier
+	time.Sleep(200 * time.Millisecond)
+
+	bottomClient, err := createRedisClient("localhost:7003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bottomClient.Close()
+	defer redisPool.Cmd("SET", "key9", "value9")
+
+	// Cache the value in every tier
+	if val, _ := bottomClient.Cmd("GET", "key9").Str(); val != "value9" {
+		t.Fatalf("Expected 'value9'. Got '%s'", val)
+	}
+
+	// Writing through the top tier should evict it all the way down
+	set := string(appendRESP(nil, respCommand("SET", "key9", "changed")))
+	sendTCP(t, set+quitRequest)
+
+	start := time.Now()
+	for {
+		val, _ := bottomClient.Cmd("GET", "key9").Str()
+		if val == "changed" {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected 'changed' within a second (well before expiry). Got '%s'", val)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	redisCache.lru.Purge()
+}
+
+// downstreamTrackers returns the number of downstream clients tracking this tier.
+func downstreamTrackers() int {
+
+	downstreamLock.Lock()
+	defer downstreamLock.Unlock()
+
+	return len(trackers)
+}
+
+func TestTrackingServer(t *testing.T) {
+
+	c := dialTest(t)
+	defer c.conn.Close()
+
+	hello := c.do(t, "HELLO", "3")
+	if hello.kind != respMap || string(hello.elems[4].str) != "proto" || hello.elems[5].num != 3 {
+		t.Fatalf("Expected a RESP3 HELLO map. Got %q", appendRESP(nil, hello))
+	}
+	if reply := c.do(t, "CLIENT", "TRACKING", "ON"); string(reply.str) != "OK" {
+		t.Fatalf("Expected '+OK'. Got %q", appendRESP(nil, reply))
+	}
+
+	// Replies are RESP3, so a missing key is null
+	if reply := c.do(t, "GET", "doesNotExist"); reply.kind != respNull {
+		t.Errorf("Expected null. Got %q", appendRESP(nil, reply))
+	}
+	if reply := c.do(t, "MGET", "key1", "key2"); len(reply.elems) != 2 {
+		t.Errorf("Expected 2 values. Got %q", appendRESP(nil, reply))
+	}
+
+	// Only keys which have been read are pushed, and only once
+	invalidateKeys("key1", "key3", "key1")
+	expected := respPushOf(respBulk([]byte("invalidate")), respCommand("key1"))
+	if msg := c.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+	invalidateKeys("key2")
+	expected = respPushOf(respBulk([]byte("invalidate")), respCommand("key2"))
+	if msg := c.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+
+	// Keys read by forwarded commands are tracked too
+	if reply := c.do(t, "HLEN", "trackedHash"); reply.kind != respInteger {
+		t.Errorf("Expected an integer. Got %q", appendRESP(nil, reply))
+	}
+	sendTCP(t, "HSET trackedHash field value\r\nDEL trackedHash\r\n"+quitRequest)
+	expected = respPushOf(respBulk([]byte("invalidate")), respCommand("trackedHash"))
+	if msg := c.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+
+	// As are keys whose cached replies expire (or are evicted to make room)
+	c.do(t, "GET", "key1")
+	expireRedisCache(0)
+	expected = respPushOf(respBulk([]byte("invalidate")), respCommand("key1"))
+	if msg := c.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+
+	invalidateAll()
+	expected = respPushOf(respBulk([]byte("invalidate")), respValue{kind: respNull, null: true})
+	if msg := c.read(t); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, msg))
+	}
+
+	if reply := c.do(t, "HELLO", "4"); reply.kind != respError || !strings.HasPrefix(string(reply.str), "NOPROTO") {
+		t.Errorf("Expected a NOPROTO error. Got %q", appendRESP(nil, reply))
+	}
+	if reply := c.do(t, "HELLO", "2"); reply.kind != respArray || len(reply.elems) != 14 {
+		t.Errorf("Expected a RESP2 HELLO array. Got %q", appendRESP(nil, reply))
+	}
+	redisCache.lru.Purge()
+}
+
+func TestClientName(t *testing.T) {
+
+	conn := dialTest(t)
+	defer conn.conn.Close()
+
+	if reply := conn.do(t, "CLIENT", "GETNAME"); !reply.null {
+		t.Errorf("Expected no name. Got %q", appendRESP(nil, reply))
+	}
+	if reply := conn.do(t, "CLIENT", "SETNAME", "worker"); string(reply.str) != "OK" {
+		t.Errorf("Expected '+OK'. Got %q", appendRESP(nil, reply))
+	}
+	if reply := conn.do(t, "CLIENT", "GETNAME"); string(reply.str) != "worker" {
+		t.Errorf("Expected 'worker'. Got %q", appendRESP(nil, reply))
+	}
+	conn.do(t, "HELLO", "2", "SETNAME", "renamed")
+	if reply := conn.do(t, "CLIENT", "GETNAME"); string(reply.str) != "renamed" {
+		t.Errorf("Expected 'renamed'. Got %q", appendRESP(nil, reply))
+	}
+}
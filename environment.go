@@ -3,15 +3,21 @@ package main
 
 import (
 	"log"
+	"net"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/radix.v2/cluster"
 )
 
 func getEnvironmentVariables() (redisAddr string, timeLimit int, cacheSize int, portStr string, portType string) {
 
-	redisAddr = os.Getenv("REDIS")
+	redisStr := os.Getenv("REDIS")
+	redisAddr, _ = parseUpstreams(redisStr)
 	if redisAddr == "" {
-		log.Printf("Invalid REDIS: '%s', setting to 'redis-backend:6379'\n", redisAddr)
+		log.Printf("Invalid REDIS: '%s', setting to 'redis-backend:6379'\n", redisStr)
 		redisAddr = "redis-backend:6379"
 	}
 
@@ -46,3 +52,316 @@ func getEnvironmentVariables() (redisAddr string, timeLimit int, cacheSize int,
 
 	return
 }
+
+// getReplicas returns the addresses of the replicas listed in REDIS.
+func getReplicas() []string {
+
+	_, replicas := parseUpstreams(os.Getenv("REDIS"))
+	return replicas
+}
+
+// parseUpstreams splits a comma-separated list of upstreams, each an
+// address optionally preceded by its role ("primary=" or "replica=").
+// Only one primary is used; other addresses are taken to be the primary.
+func parseUpstreams(list string) (primary string, replicas []string) {
+
+	for _, upstream := range splitList(list) {
+		role, addr := "primary", upstream
+		if i := strings.Index(upstream, "="); i >= 0 {
+			role, addr = strings.ToLower(upstream[:i]), upstream[i+1:]
+		}
+		switch {
+		case role == "replica" && addr != "":
+			replicas = append(replicas, addr)
+		case role == "primary" && addr != "" && primary == "":
+			primary = addr
+		default:
+			log.Printf("Invalid REDIS upstream: '%s', ignoring it\n", upstream)
+		}
+	}
+
+	return
+}
+
+func getIdleTimeout() (idleTimeout int) {
+
+	idleTimeoutStr := os.Getenv("IDLE_TIMEOUT")
+	idleTimeout, err := strconv.Atoi(idleTimeoutStr)
+	if err != nil || idleTimeout < 0 {
+		log.Printf("Invalid IDLE_TIMEOUT: '%s', setting to 0 (never time out)\n", idleTimeoutStr)
+		idleTimeout = 0
+	}
+
+	return
+}
+
+func getForwardingVariables() (forwardAllow []string, forwardDeny []string) {
+
+	forwardAllow = commandList(os.Getenv("FORWARD_ALLOW"))
+	forwardDeny = commandList(os.Getenv("FORWARD_DENY"))
+
+	return
+}
+
+// commandList splits a comma-separated list of Redis commands.
+func commandList(list string) []string {
+
+	cmds := splitList(list)
+	for i, cmd := range cmds {
+		cmds[i] = strings.ToUpper(cmd)
+	}
+	return cmds
+}
+
+// splitList splits a comma-separated list, dropping any empty items.
+func splitList(list string) []string {
+
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getUpdateOnWrite() (updateOnWrite bool) {
+
+	updateOnWriteStr := os.Getenv("UPDATE_ON_WRITE")
+	updateOnWrite, err := strconv.ParseBool(updateOnWriteStr)
+	if err != nil {
+		log.Printf("Invalid UPDATE_ON_WRITE: '%s', setting to false\n", updateOnWriteStr)
+		updateOnWrite = false
+	}
+
+	return
+}
+
+func getKeyspaceNotifications() (keyspaceNotifications bool) {
+
+	keyspaceNotificationsStr := os.Getenv("KEYSPACE_NOTIFICATIONS")
+	if keyspaceNotificationsStr == "" {
+		return false
+	}
+	keyspaceNotifications, err := strconv.ParseBool(keyspaceNotificationsStr)
+	if err != nil {
+		log.Printf("Invalid KEYSPACE_NOTIFICATIONS: '%s', setting to false\n", keyspaceNotificationsStr)
+		keyspaceNotifications = false
+	}
+
+	return
+}
+
+func getTrackingVariables() (clientTracking bool, trackingPrefixes []string) {
+
+	clientTrackingStr := os.Getenv("CLIENT_TRACKING")
+	if clientTrackingStr == "" {
+		return false, nil
+	}
+	clientTracking, err := strconv.ParseBool(clientTrackingStr)
+	if err != nil {
+		log.Printf("Invalid CLIENT_TRACKING: '%s', setting to false\n", clientTrackingStr)
+		clientTracking = false
+	}
+	trackingPrefixes = splitList(os.Getenv("TRACKING_PREFIXES"))
+
+	return
+}
+
+func getUpstreamProtocol() (upstreamProtocol int) {
+
+	upstreamProtocolStr := os.Getenv("UPSTREAM_PROTOCOL")
+	if upstreamProtocolStr == "" {
+		return 2
+	}
+	upstreamProtocol, err := strconv.Atoi(upstreamProtocolStr)
+	if err != nil || (upstreamProtocol != 2 && upstreamProtocol != 3) {
+		log.Printf("Invalid UPSTREAM_PROTOCOL: '%s', setting to 2\n", upstreamProtocolStr)
+		upstreamProtocol = 2
+	}
+
+	return
+}
+
+func getPoolSize() (poolSize int) {
+
+	poolSizeStr := os.Getenv("POOL_SIZE")
+	if poolSizeStr == "" {
+		return 10
+	}
+	poolSize, err := strconv.Atoi(poolSizeStr)
+	if err != nil || poolSize < 1 {
+		log.Printf("Invalid POOL_SIZE: '%s', setting to 10\n", poolSizeStr)
+		poolSize = 10
+	}
+
+	return
+}
+
+func getUpstreamRetries() (retries int) {
+
+	retriesStr := os.Getenv("UPSTREAM_RETRIES")
+	if retriesStr == "" {
+		return 3
+	}
+	retries, err := strconv.Atoi(retriesStr)
+	if err != nil || retries < 0 {
+		log.Printf("Invalid UPSTREAM_RETRIES: '%s', setting to 3\n", retriesStr)
+		retries = 3
+	}
+
+	return
+}
+
+func getSentinelVariables() (sentinels []string, masterName string, flush bool) {
+
+	sentinels = splitList(os.Getenv("SENTINEL"))
+
+	masterName = os.Getenv("SENTINEL_MASTER")
+	if masterName == "" {
+		masterName = "mymaster"
+	}
+
+	flushStr := os.Getenv("SENTINEL_FLUSH")
+	flush, err := strconv.ParseBool(flushStr)
+	if err != nil {
+		if flushStr != "" {
+			log.Printf("Invalid SENTINEL_FLUSH: '%s', setting to false\n", flushStr)
+		}
+		flush = false
+	}
+
+	return
+}
+
+func getClusterMode() (clusterMode bool) {
+
+	clusterModeStr := os.Getenv("CLUSTER")
+	if clusterModeStr == "" {
+		return false
+	}
+	clusterMode, err := strconv.ParseBool(clusterModeStr)
+	if err != nil {
+		log.Printf("Invalid CLUSTER: '%s', setting to false\n", clusterModeStr)
+		clusterMode = false
+	}
+
+	return
+}
+
+// getClusterSlots returns the slot map of the proxy tier, a comma-separated
+// list of slot ranges and the proxies serving them (for example
+// '0-8191=proxy-a:6379,8192-16383=proxy-b:6379'), and this proxy's address
+// among them. Invalid (or overlapping) ranges are ignored.
+func getClusterSlots() (slots []slotRange, announce string) {
+
+	slotsStr := os.Getenv("CLUSTER_SLOTS")
+	for _, item := range splitList(slotsStr) {
+		r, ok := parseSlotRange(item)
+		for _, other := range slots {
+			ok = ok && (r.end < other.start || r.start > other.end)
+		}
+		if !ok {
+			log.Printf("Invalid CLUSTER_SLOTS range: '%s', ignoring it\n", item)
+			continue
+		}
+		slots = append(slots, r)
+	}
+	if len(slots) == 0 {
+		return nil, ""
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].start < slots[j].start })
+
+	announce = os.Getenv("CLUSTER_ANNOUNCE")
+	for _, r := range slots {
+		if r.addr == announce {
+			return
+		}
+	}
+	log.Printf("Invalid CLUSTER_ANNOUNCE: '%s' (not in CLUSTER_SLOTS), not presenting as a cluster\n", announce)
+	return nil, ""
+}
+
+// parseSlotRange parses a slot range ('start-end' or a single slot) and
+// the address of the proxy serving it, such as '0-8191=proxy-a:6379'.
+func parseSlotRange(item string) (r slotRange, ok bool) {
+
+	i := strings.Index(item, "=")
+	if i < 0 || item[i+1:] == "" {
+		return r, false
+	}
+	r.addr = item[i+1:]
+	bounds := strings.SplitN(item[:i], "-", 2)
+	var err error
+	if r.start, err = strconv.Atoi(bounds[0]); err != nil {
+		return r, false
+	}
+	r.end = r.start
+	if len(bounds) == 2 {
+		if r.end, err = strconv.Atoi(bounds[1]); err != nil {
+			return r, false
+		}
+	}
+	return r, r.start >= 0 && r.start <= r.end && r.end < cluster.NumSlots
+}
+
+// getShards returns the upstream masters to shard keys across, a
+// comma-separated list of addresses each optionally followed by its weight
+// (for example 'redis-a:6379,redis-b:6379*2').
+func getShards() (addrs []string, weights []int) {
+
+	seen := make(map[string]bool)
+	for _, item := range splitList(os.Getenv("SHARDS")) {
+		addr, weight := item, 1
+		if i := strings.LastIndex(item, "*"); i >= 0 {
+			var err error
+			addr = item[:i]
+			if weight, err = strconv.Atoi(item[i+1:]); err != nil {
+				weight = 0
+			}
+		}
+		if addr == "" || weight < 1 || seen[addr] {
+			log.Printf("Invalid SHARDS shard: '%s', ignoring it\n", item)
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+		weights = append(weights, weight)
+	}
+
+	return
+}
+
+func getShardVirtualNodes() (vnodes int) {
+
+	vnodesStr := os.Getenv("SHARD_VNODES")
+	if vnodesStr == "" {
+		return 160
+	}
+	vnodes, err := strconv.Atoi(vnodesStr)
+	if err != nil || vnodes < 1 {
+		log.Printf("Invalid SHARD_VNODES: '%s', setting to 160\n", vnodesStr)
+		vnodes = 160
+	}
+
+	return
+}
+
+// getPeerVariables returns the sibling proxies to fill misses from: those
+// listed, and those found from a DNS name (host:port), with this proxy's
+// address among them (found from its own addresses, if not given).
+func getPeerVariables() (peers []string, peersDNS string, peerSelf string) {
+
+	peers = splitList(os.Getenv("PEERS"))
+
+	peersDNS = os.Getenv("PEERS_DNS")
+	if _, _, err := net.SplitHostPort(peersDNS); err != nil && peersDNS != "" {
+		log.Printf("Invalid PEERS_DNS: '%s' (not host:port), ignoring it\n", peersDNS)
+		peersDNS = ""
+	}
+
+	peerSelf = os.Getenv("PEER_SELF")
+
+	return
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -31,3 +32,296 @@ func TestEnvironmentDefaults(t *testing.T) {
 		t.Errorf("Expected type 'http'. Got '%s'", portType)
 	}
 }
+
+func TestUpstreams(t *testing.T) {
+
+	os.Clearenv()
+
+	if replicas := getReplicas(); replicas != nil {
+		t.Errorf("Expected no replicas. Got %q", replicas)
+	}
+
+	os.Setenv("REDIS", "replica=zone-a:6379, primary=master:6379,replica=zone-b:6379,other=other:6379")
+	redisAddr, _, _, _, _ := getEnvironmentVariables()
+	if redisAddr != "master:6379" {
+		t.Errorf("Expected address 'master:6379'. Got '%s'", redisAddr)
+	}
+	if replicas := getReplicas(); !reflect.DeepEqual(replicas, []string{"zone-a:6379", "zone-b:6379"}) {
+		t.Errorf("Expected replicas [zone-a:6379 zone-b:6379]. Got %q", replicas)
+	}
+
+	// A single address is the primary
+	os.Setenv("REDIS", "master:6379")
+	redisAddr, _, _, _, _ = getEnvironmentVariables()
+	if redisAddr != "master:6379" {
+		t.Errorf("Expected address 'master:6379'. Got '%s'", redisAddr)
+	}
+
+	os.Setenv("REDIS", "replica=zone-a:6379")
+	redisAddr, _, _, _, _ = getEnvironmentVariables()
+	if redisAddr != "redis-backend:6379" {
+		t.Errorf("Expected address 'redis-backend:6379'. Got '%s'", redisAddr)
+	}
+	os.Clearenv()
+}
+
+func TestIdleTimeout(t *testing.T) {
+
+	os.Clearenv()
+
+	if idleTimeout := getIdleTimeout(); idleTimeout != 0 {
+		t.Errorf("Expected idle timeout '0'. Got '%d'", idleTimeout)
+	}
+
+	os.Setenv("IDLE_TIMEOUT", "-1")
+	if idleTimeout := getIdleTimeout(); idleTimeout != 0 {
+		t.Errorf("Expected idle timeout '0'. Got '%d'", idleTimeout)
+	}
+
+	os.Setenv("IDLE_TIMEOUT", "30000")
+	if idleTimeout := getIdleTimeout(); idleTimeout != 30000 {
+		t.Errorf("Expected idle timeout '30000'. Got '%d'", idleTimeout)
+	}
+	os.Clearenv()
+}
+
+func TestForwardingVariables(t *testing.T) {
+
+	os.Clearenv()
+
+	forwardAllow, forwardDeny := getForwardingVariables()
+	if forwardAllow != nil || forwardDeny != nil {
+		t.Errorf("Expected no forwarding lists. Got %v and %v", forwardAllow, forwardDeny)
+	}
+
+	os.Setenv("FORWARD_DENY", "flushall, CONFIG,,")
+	_, forwardDeny = getForwardingVariables()
+	if len(forwardDeny) != 2 || forwardDeny[0] != "FLUSHALL" || forwardDeny[1] != "CONFIG" {
+		t.Errorf("Expected [FLUSHALL CONFIG]. Got %v", forwardDeny)
+	}
+	os.Clearenv()
+}
+
+func TestUpdateOnWrite(t *testing.T) {
+
+	os.Clearenv()
+
+	if updateOnWrite := getUpdateOnWrite(); updateOnWrite {
+		t.Errorf("Expected update on write 'false'. Got '%t'", updateOnWrite)
+	}
+
+	os.Setenv("UPDATE_ON_WRITE", "true")
+	if updateOnWrite := getUpdateOnWrite(); !updateOnWrite {
+		t.Errorf("Expected update on write 'true'. Got '%t'", updateOnWrite)
+	}
+	os.Clearenv()
+}
+
+func TestKeyspaceNotificationsVariable(t *testing.T) {
+
+	os.Clearenv()
+
+	if keyspaceNotifications := getKeyspaceNotifications(); keyspaceNotifications {
+		t.Errorf("Expected keyspace notifications 'false'. Got '%t'", keyspaceNotifications)
+	}
+
+	os.Setenv("KEYSPACE_NOTIFICATIONS", "true")
+	if keyspaceNotifications := getKeyspaceNotifications(); !keyspaceNotifications {
+		t.Errorf("Expected keyspace notifications 'true'. Got '%t'", keyspaceNotifications)
+	}
+	os.Clearenv()
+}
+
+func TestTrackingVariables(t *testing.T) {
+
+	os.Clearenv()
+
+	clientTracking, trackingPrefixes := getTrackingVariables()
+	if clientTracking || trackingPrefixes != nil {
+		t.Errorf("Expected no client tracking. Got '%t' and %v", clientTracking, trackingPrefixes)
+	}
+
+	os.Setenv("CLIENT_TRACKING", "true")
+	os.Setenv("TRACKING_PREFIXES", "user:, Session:")
+	clientTracking, trackingPrefixes = getTrackingVariables()
+	if !clientTracking || len(trackingPrefixes) != 2 || trackingPrefixes[0] != "user:" || trackingPrefixes[1] != "Session:" {
+		t.Errorf("Expected client tracking of [user: Session:]. Got '%t' and %v", clientTracking, trackingPrefixes)
+	}
+	os.Clearenv()
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+
+	os.Clearenv()
+
+	if upstreamProtocol := getUpstreamProtocol(); upstreamProtocol != 2 {
+		t.Errorf("Expected upstream protocol '2'. Got '%d'", upstreamProtocol)
+	}
+
+	os.Setenv("UPSTREAM_PROTOCOL", "3")
+	if upstreamProtocol := getUpstreamProtocol(); upstreamProtocol != 3 {
+		t.Errorf("Expected upstream protocol '3'. Got '%d'", upstreamProtocol)
+	}
+
+	os.Setenv("UPSTREAM_PROTOCOL", "4")
+	if upstreamProtocol := getUpstreamProtocol(); upstreamProtocol != 2 {
+		t.Errorf("Expected upstream protocol '2'. Got '%d'", upstreamProtocol)
+	}
+	os.Clearenv()
+}
+
+func TestPoolSize(t *testing.T) {
+
+	os.Clearenv()
+
+	if poolSize := getPoolSize(); poolSize != 10 {
+		t.Errorf("Expected pool size '10'. Got '%d'", poolSize)
+	}
+
+	os.Setenv("POOL_SIZE", "25")
+	if poolSize := getPoolSize(); poolSize != 25 {
+		t.Errorf("Expected pool size '25'. Got '%d'", poolSize)
+	}
+
+	os.Setenv("POOL_SIZE", "0")
+	if poolSize := getPoolSize(); poolSize != 10 {
+		t.Errorf("Expected pool size '10'. Got '%d'", poolSize)
+	}
+	os.Clearenv()
+}
+
+func TestUpstreamRetries(t *testing.T) {
+
+	os.Clearenv()
+
+	if retries := getUpstreamRetries(); retries != 3 {
+		t.Errorf("Expected '3' retries. Got '%d'", retries)
+	}
+
+	os.Setenv("UPSTREAM_RETRIES", "0")
+	if retries := getUpstreamRetries(); retries != 0 {
+		t.Errorf("Expected '0' retries. Got '%d'", retries)
+	}
+
+	os.Setenv("UPSTREAM_RETRIES", "-1")
+	if retries := getUpstreamRetries(); retries != 3 {
+		t.Errorf("Expected '3' retries. Got '%d'", retries)
+	}
+	os.Clearenv()
+}
+
+func TestSentinelVariables(t *testing.T) {
+
+	os.Clearenv()
+
+	sentinels, masterName, flush := getSentinelVariables()
+	if sentinels != nil || masterName != "mymaster" || flush {
+		t.Errorf("Expected no sentinels, 'mymaster' and false. Got %q, '%s' and %t", sentinels, masterName, flush)
+	}
+
+	os.Setenv("SENTINEL", "sentinel-a:26379,sentinel-b:26379")
+	os.Setenv("SENTINEL_MASTER", "cache")
+	os.Setenv("SENTINEL_FLUSH", "true")
+	sentinels, masterName, flush = getSentinelVariables()
+	if !reflect.DeepEqual(sentinels, []string{"sentinel-a:26379", "sentinel-b:26379"}) || masterName != "cache" || !flush {
+		t.Errorf("Expected [sentinel-a:26379 sentinel-b:26379], 'cache' and true. Got %q, '%s' and %t", sentinels, masterName, flush)
+	}
+	os.Clearenv()
+}
+
+func TestClusterMode(t *testing.T) {
+
+	os.Clearenv()
+
+	if clusterMode := getClusterMode(); clusterMode {
+		t.Errorf("Expected cluster mode 'false'. Got '%t'", clusterMode)
+	}
+
+	os.Setenv("CLUSTER", "true")
+	if clusterMode := getClusterMode(); !clusterMode {
+		t.Errorf("Expected cluster mode 'true'. Got '%t'", clusterMode)
+	}
+
+	os.Setenv("CLUSTER", "maybe")
+	if clusterMode := getClusterMode(); clusterMode {
+		t.Errorf("Expected cluster mode 'false'. Got '%t'", clusterMode)
+	}
+	os.Clearenv()
+}
+
+func TestClusterSlots(t *testing.T) {
+
+	os.Clearenv()
+
+	if slots, announce := getClusterSlots(); slots != nil || announce != "" {
+		t.Errorf("Expected no slots. Got %v and '%s'", slots, announce)
+	}
+
+	// Ranges are sorted, and invalid or overlapping ones ignored
+	os.Setenv("CLUSTER_SLOTS", "8192-16383=proxy-b:6379,0-8191=proxy-a:6379,100-200=proxy-c:6379,9-8=proxy-c:6379,16384=proxy-c:6379,x=proxy-c:6379")
+	os.Setenv("CLUSTER_ANNOUNCE", "proxy-b:6379")
+	slots, announce := getClusterSlots()
+	expected := []slotRange{{0, 8191, "proxy-a:6379"}, {8192, 16383, "proxy-b:6379"}}
+	if !reflect.DeepEqual(slots, expected) || announce != "proxy-b:6379" {
+		t.Errorf("Expected %v and 'proxy-b:6379'. Got %v and '%s'", expected, slots, announce)
+	}
+
+	// This proxy must be in the slot map
+	os.Setenv("CLUSTER_ANNOUNCE", "proxy-c:6379")
+	if slots, announce := getClusterSlots(); slots != nil || announce != "" {
+		t.Errorf("Expected no slots. Got %v and '%s'", slots, announce)
+	}
+	os.Clearenv()
+}
+
+func TestShards(t *testing.T) {
+
+	os.Clearenv()
+
+	if addrs, weights := getShards(); addrs != nil || weights != nil {
+		t.Errorf("Expected no shards. Got %q and %v", addrs, weights)
+	}
+	if vnodes := getShardVirtualNodes(); vnodes != 160 {
+		t.Errorf("Expected 160 virtual nodes. Got %d", vnodes)
+	}
+
+	// Invalid weights and repeated shards are ignored
+	os.Setenv("SHARDS", "redis-a:6379,redis-b:6379*2,redis-c:6379*0,redis-d:6379*x,redis-a:6379*3")
+	os.Setenv("SHARD_VNODES", "40")
+	addrs, weights := getShards()
+	if !reflect.DeepEqual(addrs, []string{"redis-a:6379", "redis-b:6379"}) || !reflect.DeepEqual(weights, []int{1, 2}) {
+		t.Errorf("Expected [redis-a:6379 redis-b:6379] and [1 2]. Got %q and %v", addrs, weights)
+	}
+	if vnodes := getShardVirtualNodes(); vnodes != 40 {
+		t.Errorf("Expected 40 virtual nodes. Got %d", vnodes)
+	}
+
+	os.Setenv("SHARD_VNODES", "0")
+	if vnodes := getShardVirtualNodes(); vnodes != 160 {
+		t.Errorf("Expected 160 virtual nodes. Got %d", vnodes)
+	}
+	os.Clearenv()
+}
+
+func TestPeerVariables(t *testing.T) {
+
+	os.Clearenv()
+
+	if peers, peersDNS, self := getPeerVariables(); peers != nil || peersDNS != "" || self != "" {
+		t.Errorf("Expected no peers. Got %q, '%s' and '%s'", peers, peersDNS, self)
+	}
+
+	os.Setenv("PEERS", "cache-a:6379,cache-b:6379")
+	os.Setenv("PEERS_DNS", "caches.local:6379")
+	os.Setenv("PEER_SELF", "cache-a:6379")
+	peers, peersDNS, self := getPeerVariables()
+	if !reflect.DeepEqual(peers, []string{"cache-a:6379", "cache-b:6379"}) || peersDNS != "caches.local:6379" || self != "cache-a:6379" {
+		t.Errorf("Expected [cache-a:6379 cache-b:6379], 'caches.local:6379' and 'cache-a:6379'. Got %q, '%s' and '%s'", peers, peersDNS, self)
+	}
+
+	os.Setenv("PEERS_DNS", "caches.local")
+	if _, peersDNS, _ := getPeerVariables(); peersDNS != "" {
+		t.Errorf("Expected no PEERS_DNS. Got '%s'", peersDNS)
+	}
+	os.Clearenv()
+}
@@ -0,0 +1,101 @@
+// forward handles the pass-through of uncached commands to the upstream Redis.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// If forwardAllow is set only those commands are forwarded;
+// commands in forwardDeny (FLUSHALL, CONFIG, ...) are never forwarded.
+var forwardAllow map[string]bool
+var forwardDeny map[string]bool
+
+// These commands change the state of the connection they are sent on
+// (or block it), so cannot be forwarded over a shared upstream connection.
+var unforwardable = map[string]bool{
+	"AUTH": true, "CLIENT": true, "HELLO": true, "RESET": true, "SELECT": true,
+	"READONLY": true, "READWRITE": true,
+	"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"MONITOR": true, "SYNC": true, "PSYNC": true, "REPLCONF": true,
+	"BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true, "BLMOVE": true, "BLMPOP": true,
+	"BZPOPMIN": true, "BZPOPMAX": true, "BZMPOP": true, "WAIT": true,
+}
+
+func setForwardingLists(allow []string, deny []string) {
+
+	forwardAllow = commandSet(allow)
+	forwardDeny = commandSet(deny)
+}
+
+func commandSet(cmds []string) map[string]bool {
+
+	if len(cmds) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(cmds))
+	for _, cmd := range cmds {
+		set[strings.ToUpper(cmd)] = true
+	}
+	return set
+}
+
+// checkForwardable returns an error reply if the command
+// may not be forwarded to the upstream Redis.
+func checkForwardable(args [][]byte) (respValue, bool) {
+
+	name := strings.ToUpper(string(args[0]))
+	if unforwardable[name] {
+		return respErr(fmt.Sprintf("ERR '%s' is not supported through this proxy", strings.ToLower(errorArg(args[0])))), false
+	}
+	if (forwardAllow != nil && !forwardAllow[name]) || forwardDeny[name] {
+		return respErr(fmt.Sprintf("NOPERM '%s' is not allowed through this proxy", strings.ToLower(errorArg(args[0])))), false
+	}
+	return respValue{}, true
+}
+
+// forwardArgs converts command arguments (after the command name)
+// for the upstream client, which sends []byte as bulk strings.
+func forwardArgs(args [][]byte) []interface{} {
+
+	fargs := make([]interface{}, len(args)-1)
+	for i, arg := range args[1:] {
+		fargs[i] = arg
+	}
+	return fargs
+}
+
+// respFromRadix converts a reply read by the upstream client (which,
+// only speaking RESP2, reads any RESP3 reply as RESP2) so it can be relayed.
+func respFromRadix(r *redis.Resp) respValue {
+
+	switch {
+	case r.IsType(redis.IOErr):
+		return respUnavailable(r.Err)
+	case r.IsType(redis.AppErr):
+		return respErr(r.Err.Error())
+	case r.IsType(redis.Nil):
+		return respNil()
+	case r.IsType(redis.SimpleStr):
+		s, _ := r.Str()
+		return respSimple(s)
+	case r.IsType(redis.BulkStr):
+		b, _ := r.Bytes()
+		return respBulk(b)
+	case r.IsType(redis.Int):
+		n, _ := r.Int64()
+		return respInt(n)
+	case r.IsType(redis.Array):
+		arr, _ := r.Array()
+		elems := make([]respValue, len(arr))
+		for i, elem := range arr {
+			elems[i] = respFromRadix(elem)
+		}
+		return respArrayOf(elems...)
+	}
+	return respErr("ERR unexpected upstream reply")
+}
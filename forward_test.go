@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+func TestForwardCommandsTCP(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	client, err := redis.Dial("tcp", "localhost:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer redisPool.Cmd("DEL", "forwardKey", "forwardList")
+
+	if res, err := client.Cmd("SET", "forwardKey", "1").Str(); err != nil || res != "OK" {
+		t.Errorf("Expected 'OK'. Got '%s' (%v)", res, err)
+	}
+	if n, err := client.Cmd("INCR", "forwardKey").Int(); err != nil || n != 2 {
+		t.Errorf("Expected '2'. Got '%d' (%v)", n, err)
+	}
+	if res, err := client.Cmd("TYPE", "forwardKey").Str(); err != nil || res != "string" {
+		t.Errorf("Expected 'string'. Got '%s' (%v)", res, err)
+	}
+	if val, err := client.Cmd("GET", "forwardKey").Str(); err != nil || val != "2" {
+		t.Errorf("Expected '2'. Got '%s' (%v)", val, err)
+	}
+
+	client.Cmd("RPUSH", "forwardList", "a", "b\r\nc")
+	list, err := client.Cmd("LRANGE", "forwardList", 0, -1).List()
+	if err != nil || len(list) != 2 || list[1] != "b\r\nc" {
+		t.Errorf("Expected [a b\\r\\nc]. Got %q (%v)", list, err)
+	}
+
+	// Upstream errors are relayed
+	if err := client.Cmd("INCR", "forwardList").Err; err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("Expected WRONGTYPE error. Got '%v'", err)
+	}
+
+	if resp := client.Cmd("GET", "noSuchKey"); !resp.IsType(redis.Nil) {
+		t.Errorf("Expected nil. Got '%v'", resp)
+	}
+	redisCache.lru.Purge()
+}
+
+func TestForwardPipelineOrderTCP(t *testing.T) {
+
+	redisCache.lru.Purge()
+	defer redisPool.Cmd("DEL", "pipelinedKey")
+
+	// The GET miss must be answered after the pipelined SET
+	set := string(appendRESP(nil, respArrayOf(respBulk([]byte("SET")), respBulk([]byte("pipelinedKey")), respBulk([]byte("new")))))
+	buf := sendTCP(t, set+wrapRedisKey("pipelinedKey")+quitRequest)
+
+	if message := string(buf); message != "+OK\r\n$3\r\nnew\r\n+OK\r\n" {
+		t.Errorf("Expected '+OK\\r\\n$3\\r\\nnew\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+	redisCache.lru.Purge()
+}
+
+func TestForwardingLists(t *testing.T) {
+
+	defer setForwardingLists(nil, nil)
+
+	ping := string(appendRESP(nil, respArrayOf(respBulk([]byte("PING")))))
+	flushAll := string(appendRESP(nil, respArrayOf(respBulk([]byte("flushall")))))
+	multi := string(appendRESP(nil, respArrayOf(respBulk([]byte("MULTI")))))
+
+	setForwardingLists(nil, []string{"FLUSHALL", "CONFIG"})
+	buf := sendTCP(t, ping+flushAll+multi+quitRequest)
+
+	expected := "+PONG\r\n" +
+		"-NOPERM 'flushall' is not allowed through this proxy\r\n" +
+		"-ERR 'multi' is not supported through this proxy\r\n" +
+		"+OK\r\n"
+	if message := string(buf); message != expected {
+		t.Errorf("Expected %q. Got %q", expected, message)
+	}
+
+	setForwardingLists([]string{"echo"}, nil)
+	buf = sendTCP(t, ping+quitRequest)
+
+	if message := string(buf); message != "-NOPERM 'ping' is not allowed through this proxy\r\n+OK\r\n" {
+		t.Errorf("Expected '-NOPERM 'ping' is not allowed through this proxy\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+
+	// GET is served from the cache regardless
+	buf = sendTCP(t, wrapRedisKey("key1")+quitRequest)
+
+	if message := string(buf); message != "$6\r\nvalue1\r\n+OK\r\n" {
+		t.Errorf("Expected '$6\\r\\nvalue1\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+	redisCache.lru.Purge()
+}
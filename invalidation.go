@@ -0,0 +1,315 @@
+// invalidation handles the eviction of cached replies when their Redis keys change.
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// If updateOnWrite is set, simple SETs (and MSETs) passing through the
+// proxy update the cached value rather than just evicting it.
+var updateOnWrite bool
+
+// A reply fetched from Redis before a key changed may arrive after the
+// change's invalidation, so invalidations are also noted against each
+// upstream round trip in flight and applied again once it has finished.
+type staleKeys struct {
+	keys []string
+	all  bool
+}
+
+var inFlight = make(map[*upstreamPipeline]*staleKeys)
+var inFlightLock sync.Mutex
+
+// keySpec gives the positions of the keys in a write command's arguments
+// (counting the command name as 0), in the same way as Redis COMMAND does.
+// A negative last key counts back from the end of the arguments.
+type keySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+var (
+	firstKey  = keySpec{1, 1, 1}
+	allKeys   = keySpec{1, -1, 1}
+	keyValues = keySpec{1, -1, 2}
+	twoKeys   = keySpec{1, 2, 1}
+	bitopKeys = keySpec{2, -1, 1}
+
+	// Blocking pops end with their timeout
+	blockingKeys = keySpec{1, -2, 1}
+)
+
+// writeCommands maps the commands which may change keys to the keys they change.
+var writeCommands = map[string]keySpec{
+	// Keys
+	"DEL": allKeys, "UNLINK": allKeys,
+	"EXPIRE": firstKey, "PEXPIRE": firstKey, "EXPIREAT": firstKey, "PEXPIREAT": firstKey,
+	"PERSIST": firstKey, "RESTORE": firstKey,
+	"RENAME": twoKeys, "RENAMENX": twoKeys, "COPY": twoKeys,
+	"MOVE": firstKey,
+
+	// Strings
+	"SET": firstKey, "SETNX": firstKey, "SETEX": firstKey, "PSETEX": firstKey,
+	"GETSET": firstKey, "GETDEL": firstKey, "GETEX": firstKey,
+	"MSET": keyValues, "MSETNX": keyValues,
+	"APPEND": firstKey, "SETRANGE": firstKey,
+	"INCR": firstKey, "INCRBY": firstKey, "INCRBYFLOAT": firstKey,
+	"DECR": firstKey, "DECRBY": firstKey,
+	"SETBIT": firstKey, "BITFIELD": firstKey, "BITOP": bitopKeys,
+	"PFADD": firstKey, "PFMERGE": allKeys,
+
+	// Hashes
+	"HSET": firstKey, "HSETNX": firstKey, "HMSET": firstKey, "HDEL": firstKey,
+	"HINCRBY": firstKey, "HINCRBYFLOAT": firstKey,
+
+	// Lists
+	"LPUSH": firstKey, "RPUSH": firstKey, "LPUSHX": firstKey, "RPUSHX": firstKey,
+	"LPOP": firstKey, "RPOP": firstKey, "LSET": firstKey, "LREM": firstKey,
+	"LTRIM": firstKey, "LINSERT": firstKey,
+	"RPOPLPUSH": twoKeys, "LMOVE": twoKeys,
+	"BLPOP": blockingKeys, "BRPOP": blockingKeys, "BRPOPLPUSH": twoKeys, "BLMOVE": twoKeys,
+	"LMPOP": {}, "BLMPOP": {},
+
+	// Sets
+	"SADD": firstKey, "SREM": firstKey, "SPOP": firstKey, "SMOVE": twoKeys,
+	"SDIFFSTORE": firstKey, "SINTERSTORE": firstKey, "SUNIONSTORE": firstKey,
+
+	// Sorted sets
+	"ZADD": firstKey, "ZINCRBY": firstKey, "ZREM": firstKey,
+	"ZREMRANGEBYSCORE": firstKey, "ZREMRANGEBYRANK": firstKey, "ZREMRANGEBYLEX": firstKey,
+	"ZPOPMIN": firstKey, "ZPOPMAX": firstKey, "BZPOPMIN": blockingKeys, "BZPOPMAX": blockingKeys,
+	"ZMPOP": {}, "BZMPOP": {},
+	"ZDIFFSTORE": firstKey, "ZINTERSTORE": firstKey, "ZUNIONSTORE": firstKey, "ZRANGESTORE": firstKey,
+
+	// Geo
+	"GEOADD": firstKey, "GEOSEARCHSTORE": firstKey,
+	"GEORADIUS": {}, "GEORADIUSBYMEMBER": {},
+
+	// Streams (consumer groups included, as reading through one changes it)
+	"XADD": firstKey, "XDEL": firstKey, "XTRIM": firstKey, "XSETID": firstKey,
+	"XGROUP": {2, 2, 1}, "XACK": firstKey, "XCLAIM": firstKey, "XAUTOCLAIM": firstKey,
+	"XREADGROUP": {},
+
+	// Sorting only writes with STORE
+	"SORT": {},
+
+	// Scripts and functions may write any of their keys (which follow the number of keys)
+	"EVAL": {}, "EVALSHA": {}, "FCALL": {},
+
+	// Databases (all keys are affected)
+	"FLUSHDB": {}, "FLUSHALL": {}, "SWAPDB": {},
+}
+
+// writtenKeys returns the keys which the command may change; if all
+// keys are affected (as with FLUSHDB) it returns true instead.
+func writtenKeys(args [][]byte) ([]string, bool) {
+
+	name := strings.ToUpper(string(args[0]))
+	spec, ok := writeCommands[name]
+	if !ok {
+		return nil, false
+	}
+
+	switch name {
+	case "FLUSHDB", "FLUSHALL", "SWAPDB":
+		return nil, true
+	case "LMPOP", "ZMPOP":
+		return numKeys(args, 1), false
+	case "EVAL", "EVALSHA", "FCALL", "BLMPOP", "BZMPOP":
+		return numKeys(args, 2), false
+	case "SORT":
+		return storeKey(args, 2), false
+	case "GEORADIUS":
+		return storeKey(args, 6), false
+	case "GEORADIUSBYMEMBER":
+		return storeKey(args, 5), false
+	case "XREADGROUP":
+		return streamKeys(args), false
+	}
+	return spec.keys(args), false
+}
+
+// numKeys returns the keys following the number of keys at args[at].
+func numKeys(args [][]byte, at int) []string {
+
+	if len(args) <= at {
+		return nil
+	}
+	n, err := strconv.Atoi(string(args[at]))
+	if err != nil || n < 0 || at+1+n > len(args) {
+		return nil
+	}
+	return keySpec{at + 1, at + n, 1}.keys(args)
+}
+
+// storeKey returns the destination of a STORE (or STOREDIST) option, the
+// last one given taking effect as with Redis. Options are parsed from
+// args[from] on, skipping the arguments of those which take any.
+func storeKey(args [][]byte, from int) []string {
+
+	var keys []string
+	for i := from; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "STORE", "STOREDIST":
+			if i+1 < len(args) {
+				keys = []string{string(args[i+1])}
+			}
+			i++
+		case "BY", "GET", "COUNT":
+			i++
+		case "LIMIT":
+			i += 2
+		}
+	}
+	return keys
+}
+
+// streamKeys returns the keys of an XREADGROUP, which are the first
+// half of the arguments after STREAMS (the rest being their IDs).
+func streamKeys(args [][]byte) []string {
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "GROUP":
+			i += 2
+		case "COUNT", "BLOCK":
+			i++
+		case "STREAMS":
+			streams := args[i+1:]
+			if len(streams) == 0 || len(streams)%2 != 0 {
+				return nil
+			}
+			return keySpec{i + 1, i + len(streams)/2, 1}.keys(args)
+		}
+	}
+	return nil
+}
+
+// keys returns the keys in the command's arguments.
+func (spec keySpec) keys(args [][]byte) []string {
+
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+
+	var keys []string
+	for i := spec.first; i <= last; i += spec.step {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
+
+// invalidateKeys evicts all of the replies cached for the keys.
+func invalidateKeys(keys ...string) {
+
+	evictKeys(keys)
+	noteStale(nil, keys, false)
+	broadcastInvalidation(keys, false)
+}
+
+// invalidateAll evicts every cached reply.
+func invalidateAll() {
+
+	redisCache.purge()
+	noteStale(nil, nil, true)
+	broadcastInvalidation(nil, true)
+}
+
+func evictKeys(keys []string) {
+
+	for _, key := range keys {
+		for _, ck := range redisCache.cachedReplies(key) {
+			redisCache.remove(ck)
+		}
+	}
+}
+
+// noteStale notes the invalidation against the round trips in flight,
+// other than the one making it (whose replies are already in order).
+func noteStale(from *upstreamPipeline, keys []string, all bool) {
+
+	dropFlights(keys, all)
+
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+
+	for p, stale := range inFlight {
+		if p == from {
+			continue
+		}
+		stale.keys = append(stale.keys, keys...)
+		stale.all = stale.all || all
+	}
+}
+
+func startFill(p *upstreamPipeline) {
+
+	inFlightLock.Lock()
+	inFlight[p] = &staleKeys{}
+	inFlightLock.Unlock()
+}
+
+// finishFill applies the invalidations made while the round trip was
+// in flight again, now that its replies have been cached.
+func finishFill(p *upstreamPipeline) {
+
+	inFlightLock.Lock()
+	stale, ok := inFlight[p]
+	delete(inFlight, p)
+	inFlightLock.Unlock()
+
+	if !ok {
+		return
+	}
+	if stale.all {
+		redisCache.purge()
+		return
+	}
+	evictKeys(stale.keys)
+}
+
+// invalidateWrite evicts the cached replies for the keys changed by a
+// write command, once Redis has replied to it in the round trip p. If
+// updateOnWrite is set the new values of successful SETs and MSETs are
+// cached instead.
+func invalidateWrite(p *upstreamPipeline, args [][]byte, reply respValue) {
+
+	keys, all := writtenKeys(args)
+	noteWrite(keys, all)
+	invalidatePeers(keys, all)
+	if all {
+		redisCache.purge()
+		noteStale(p, nil, true)
+		broadcastInvalidation(nil, true)
+		return
+	}
+	evictKeys(keys)
+	noteStale(p, keys, false)
+	broadcastInvalidation(keys, false)
+
+	if !updateOnWrite || reply.kind != respSimpleString || string(reply.str) != "OK" {
+		return
+	}
+	switch name := strings.ToUpper(string(args[0])); {
+	case name == "SET" && len(args) == 3:
+		cacheWrittenValue(string(args[1]), args[2])
+	case name == "MSET" && len(args)%2 == 1:
+		for i := 1; i < len(args); i += 2 {
+			cacheWrittenValue(string(args[i]), args[i+1])
+		}
+	}
+}
+
+func cacheWrittenValue(key string, val []byte) {
+
+	entry := &valueStruct{respBulk(val), time.Now().UnixNano(), 0}
+	redisCache.add(getCacheKey(key), entry)
+}
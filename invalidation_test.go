@@ -0,0 +1,228 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+func TestWrittenKeys(t *testing.T) {
+
+	tests := []struct {
+		cmd  string
+		keys []string
+		all  bool
+	}{
+		{"GET k", nil, false},
+		{"SET k v", []string{"k"}, false},
+		{"set k v EX 10", []string{"k"}, false},
+		{"HSET h f v", []string{"h"}, false},
+		{"DEL k1 k2 k3", []string{"k1", "k2", "k3"}, false},
+		{"MSET k1 v1 k2 v2", []string{"k1", "k2"}, false},
+		{"RENAME k1 k2", []string{"k1", "k2"}, false},
+		{"BITOP AND dest k1 k2", []string{"dest", "k1", "k2"}, false},
+		{"EVAL script 2 k1 k2 arg", []string{"k1", "k2"}, false},
+		{"EVAL script 3 k1", nil, false},
+		{"FCALL fn 1 k1 arg", []string{"k1"}, false},
+		{"LMPOP 2 k1 k2 LEFT COUNT 2", []string{"k1", "k2"}, false},
+		{"ZMPOP 1 k1 MIN", []string{"k1"}, false},
+		{"BZMPOP 0 2 k1 k2 MAX", []string{"k1", "k2"}, false},
+		{"BLPOP k1 k2 0", []string{"k1", "k2"}, false},
+		{"SORT k BY w_* LIMIT 0 10 GET o_* STORE dest", []string{"dest"}, false},
+		{"SORT k GET store", nil, false},
+		{"GEOSEARCHSTORE dest src FROMLONLAT 0 0 BYRADIUS 1 km", []string{"dest"}, false},
+		{"GEORADIUS k 0 0 1 km COUNT 5 STOREDIST dest", []string{"dest"}, false},
+		{"GEORADIUSBYMEMBER k m 1 km WITHDIST", nil, false},
+		{"XREADGROUP GROUP g streams COUNT 1 STREAMS s1 s2 0 0", []string{"s1", "s2"}, false},
+		{"XACK s g 0-1", []string{"s"}, false},
+		{"XCLAIM s g c 0 0-1", []string{"s"}, false},
+		{"XAUTOCLAIM s g c 0 0", []string{"s"}, false},
+		{"XGROUP CREATE s g $", []string{"s"}, false},
+		{"XGROUP HELP", nil, false},
+		{"XSETID s 0-1", []string{"s"}, false},
+		{"FLUSHALL", nil, true},
+	}
+
+	for _, test := range tests {
+		var args [][]byte
+		for _, arg := range strings.Fields(test.cmd) {
+			args = append(args, []byte(arg))
+		}
+		keys, all := writtenKeys(args)
+		if !reflect.DeepEqual(keys, test.keys) || all != test.all {
+			t.Errorf("%s: expected %v (all keys %v). Got %v (all keys %v)", test.cmd, test.keys, test.all, keys, all)
+		}
+	}
+}
+
+func TestReadYourWritesTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	client, err := redis.Dial("tcp", "localhost:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer redisPool.Cmd("DEL", "rywKey1", "rywKey2", "rywHash")
+
+	client.Cmd("MSET", "rywKey1", "old1", "rywKey2", "old2")
+	client.Cmd("HSET", "rywHash", "field", "old")
+
+	// Cache the old values
+	client.Cmd("GET", "rywKey1")
+	client.Cmd("MGET", "rywKey1", "rywKey2")
+	client.Cmd("HGET", "rywHash", "field")
+	client.Cmd("HGETALL", "rywHash")
+
+	client.Cmd("SET", "rywKey1", "new1")
+	if val, _ := client.Cmd("GET", "rywKey1").Str(); val != "new1" {
+		t.Errorf("Expected 'new1'. Got '%s'", val)
+	}
+
+	client.Cmd("HSET", "rywHash", "field", "new")
+	if val, _ := client.Cmd("HGET", "rywHash", "field").Str(); val != "new" {
+		t.Errorf("Expected 'new'. Got '%s'", val)
+	}
+	if hash, _ := client.Cmd("HGETALL", "rywHash").Map(); hash["field"] != "new" {
+		t.Errorf("Expected 'new'. Got '%s'", hash["field"])
+	}
+
+	client.Cmd("DEL", "rywKey1", "rywKey2")
+	vals, _ := client.Cmd("MGET", "rywKey1", "rywKey2").Array()
+	if len(vals) != 2 || !vals[0].IsType(redis.Nil) || !vals[1].IsType(redis.Nil) {
+		t.Errorf("Expected two nils. Got '%v'", vals)
+	}
+
+	// Only the (re-cached) hash entries are left
+	if len(redisCache.keys) != 1 {
+		t.Errorf("Expected 1 indexed key. Got %d", len(redisCache.keys))
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+
+	if len(redisCache.keys) != 0 {
+		t.Errorf("Expected no indexed keys. Got %d", len(redisCache.keys))
+	}
+}
+
+func TestPipelinedReadYourWritesTCP(t *testing.T) {
+
+	redisCache.lru.Purge()
+	defer redisPool.Cmd("DEL", "rywKey")
+
+	redisPool.Cmd("SET", "rywKey", "old")
+	getRedisValue("rywKey")
+
+	// The GET must not be answered from the (stale) cache
+	set := string(appendRESP(nil, respArrayOf(respBulk([]byte("SET")), respBulk([]byte("rywKey")), respBulk([]byte("new")))))
+	buf := sendTCP(t, set+wrapRedisKey("rywKey")+quitRequest)
+
+	if message := string(buf); message != "+OK\r\n$3\r\nnew\r\n+OK\r\n" {
+		t.Errorf("Expected '+OK\\r\\n$3\\r\\nnew\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+	redisCache.lru.Purge()
+}
+
+func TestUpdateOnWriteTCP(t *testing.T) {
+
+	updateOnWrite = true
+	defer func() { updateOnWrite = false }()
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+	defer redisPool.Cmd("DEL", "updatedKey")
+
+	set := string(appendRESP(nil, respArrayOf(respBulk([]byte("SET")), respBulk([]byte("updatedKey")), respBulk([]byte("new")))))
+	sendTCP(t, set+quitRequest)
+
+	// Served from the cache
+	buf := sendTCP(t, wrapRedisKey("updatedKey")+quitRequest)
+
+	if message := string(buf); message != "$3\r\nnew\r\n+OK\r\n" {
+		t.Errorf("Expected '$3\\r\\nnew\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+	if cacheHit != 1 {
+		t.Errorf("Expected cacheHit '1'. Got '%d'", cacheHit)
+	}
+	if cacheMiss != 0 {
+		t.Errorf("Expected cacheMiss '0'. Got '%d'", cacheMiss)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestInvalidationDuringFill(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	// An invalidation arriving while the GET is in flight
+	var p upstreamPipeline
+	p.add("GET", "key7")
+	resps := p.run()
+	invalidateKeys("key7")
+	cacheRedisValue("key7", resps[0], p.deadline("key7"))
+	p.finish()
+
+	if redisCache.lru.Contains(getCacheKey("key7")) {
+		t.Errorf("Expected 'key7' not to be cached")
+	}
+
+	// And the same for all keys
+	p = upstreamPipeline{}
+	p.add("GET", "key8")
+	resps = p.run()
+	invalidateAll()
+	cacheRedisValue("key8", resps[0], p.deadline("key8"))
+	p.finish()
+
+	if redisCache.lru.Len() != 0 {
+		t.Errorf("Expected cache size '0'. Got '%d'", redisCache.lru.Len())
+	}
+	if len(inFlight) != 0 {
+		t.Errorf("Expected no round trips in flight. Got '%d'", len(inFlight))
+	}
+	redisCache.lru.Purge()
+}
+
+func TestInvalidationDuringHit(t *testing.T) {
+
+	redisCache.lru.Purge()
+	ck := getCacheKey("key9")
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Hits racing an invalidation must not bring the reply back
+	for i := 0; i < 500; i++ {
+		redisCache.add(ck, &valueStruct{respBulk([]byte("value9")), time.Now().UnixNano(), 0})
+
+		var wg, hit sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			hit.Add(1)
+			go func() {
+				defer wg.Done()
+				getCachedReply(ck)
+				hit.Done()
+				for k := 0; k < 100; k++ {
+					getCachedReply(ck)
+				}
+			}()
+		}
+		hit.Wait()
+		invalidateKeys("key9")
+		wg.Wait()
+
+		if redisCache.lru.Contains(ck) {
+			t.Fatalf("Expected 'key9' not to be cached after invalidation %d", i)
+		}
+	}
+	redisCache.lru.Purge()
+}
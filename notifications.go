@@ -0,0 +1,125 @@
+// notifications handles the invalidation of cached replies from Redis keyspace notifications.
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/pubsub"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// The proxy only uses database 0 (it never SELECTs another database).
+// The Redis master must be configured to send the notifications, for
+// example with 'CONFIG SET notify-keyspace-events KA'.
+const (
+	keyspacePrefix = "__keyspace@0__:"
+	keyeventPrefix = "__keyevent@0__:"
+)
+
+// How long to wait before first resubscribing after losing the subscription
+var resubscribeDelay = time.Second
+
+var notificationsStop chan bool
+
+// The current subscription client, so that it can be closed on stopping
+var notificationsClient *redis.Client
+var notificationsLock sync.Mutex
+
+func startNotificationListener(addr string) {
+
+	stop := make(chan bool)
+	notificationsStop = stop
+	go func() {
+		for retry := 0; ; retry++ {
+			started := time.Now()
+			err := listenForNotifications(addr)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			log.Printf("Keyspace notifications from '%s' lost, error: %s\n", addr, err)
+
+			// Resubscribe after a while, backing off while it keeps failing
+			if time.Since(started) > maxBackoffFactor*resubscribeDelay {
+				retry = 0
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff(resubscribeDelay, retry)):
+			}
+		}
+	}()
+}
+
+func stopNotificationListener() {
+
+	if notificationsStop == nil {
+		return
+	}
+	close(notificationsStop)
+	notificationsStop = nil
+
+	notificationsLock.Lock()
+	defer notificationsLock.Unlock()
+
+	if notificationsClient != nil {
+		notificationsClient.Close()
+	}
+}
+
+// listenForNotifications subscribes to keyspace and keyevent notifications,
+// invalidating the keys they name until the subscription fails.
+func listenForNotifications(addr string) error {
+
+	client, err := createRedisClient(addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	notificationsLock.Lock()
+	notificationsClient = client
+	notificationsLock.Unlock()
+
+	sub := pubsub.NewSubClient(client)
+	resp := sub.PSubscribe(keyspacePrefix+"*", keyeventPrefix+"*")
+	if resp.Err != nil {
+		return resp.Err
+	}
+
+	// Changes may have been missed while not subscribed
+	invalidateAll()
+	log.Printf("Subscribed to keyspace notifications from '%s'\n", addr)
+
+	for {
+		resp = sub.Receive()
+		if resp.Timeout() {
+			continue
+		}
+		if resp.Err != nil {
+			return resp.Err
+		}
+		if resp.Type == pubsub.Message {
+			invalidateNotification(resp.Channel, resp.Message)
+		}
+	}
+}
+
+// invalidateNotification evicts the key named by a keyspace notification
+// (where the channel names the key) or keyevent notification (where the
+// message names the key).
+func invalidateNotification(channel string, message string) {
+
+	if strings.HasPrefix(channel, keyspacePrefix) {
+		invalidateKeys(strings.TrimPrefix(channel, keyspacePrefix))
+		return
+	}
+	if strings.HasPrefix(channel, keyeventPrefix) {
+		invalidateKeys(message)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceNotificationEviction(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	// Stand-in upstream which confirms subscriptions (Redis itself
+	// can't be relied upon to have notifications enabled)
+	upstream := startStandIn(t, func(args [][]byte) []respValue {
+		if strings.ToUpper(string(args[0])) != "PSUBSCRIBE" {
+			return []respValue{respErr("ERR unknown command")}
+		}
+		var replies []respValue
+		for i, pattern := range args[1:] {
+			replies = append(replies, respArrayOf(respBulk([]byte("psubscribe")), respBulk(pattern), respInt(int64(i+1))))
+		}
+		return replies
+	})
+	defer upstream.close()
+
+	delay := resubscribeDelay
+	resubscribeDelay = 10 * time.Millisecond
+	defer func() { resubscribeDelay = delay }()
+
+	// Subscribing evicts the keys cached before
+	defer stopNotificationListener()
+	checkNotificationEvicts(t, "key1", func() {
+		startNotificationListener(upstream.addr())
+		upstream.waitFor(t, "PSUBSCRIBE")
+	})
+
+	// Keyspace notifications name the key in the channel
+	checkNotificationEvicts(t, "key1", func() {
+		upstream.push(respCommand("pmessage", "__keyspace@0__:*", "__keyspace@0__:key1", "set"))
+	})
+
+	// Keyevent notifications name the key in the message
+	checkNotificationEvicts(t, "key2", func() {
+		upstream.push(respCommand("pmessage", "__keyevent@0__:*", "__keyevent@0__:del", "key2"))
+	})
+
+	// Losing the subscription should resubscribe, evicting the keys
+	// cached before (which may have changed in the meantime)
+	checkNotificationEvicts(t, "key3", func() {
+		upstream.drop()
+		upstream.waitFor(t, "PSUBSCRIBE")
+	})
+	checkNotificationEvicts(t, "key3", func() {
+		upstream.push(respCommand("pmessage", "__keyspace@0__:*", "__keyspace@0__:key3", "expired"))
+	})
+	redisCache.lru.Purge()
+}
+
+// checkNotificationEvicts caches the key, then checks that it is evicted
+// (within a second) after the notification is sent.
+func checkNotificationEvicts(t *testing.T, key string, notify func()) {
+
+	_, err := getRedisValue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !redisCache.lru.Contains(getCacheKey(key)) {
+		t.Fatalf("Expected '%s' to be cached", key)
+	}
+
+	notify()
+	for i := 0; i < 100 && redisCache.lru.Contains(getCacheKey(key)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if redisCache.lru.Contains(getCacheKey(key)) {
+		t.Errorf("Expected '%s' to be evicted by the notification", key)
+	}
+}
@@ -0,0 +1,402 @@
+// peers handles filling cache misses from sibling proxies, each owning a share of the keys, so that a tier fetches each key upstream once.
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// The name peers give their connections (with CLIENT SETNAME), so that
+// misses for them are only ever sent upstream (and never round in circles)
+const peerClientName = "redis-cache-peer"
+
+// The command peers send each other to evict the keys written through
+// them (or, without any keys, every key). It is only served to connections
+// named as a peer's, which any client may name itself, so it keeps clients
+// from evicting keys by accident rather than by design.
+const peerInvalidate = "PEER.INVALIDATE"
+
+// Cache misses filled from the peers owning them
+var peerFills = expvar.NewInt("peerFills")
+
+// The ring of peers (nil unless filling from them), this proxy's address
+// among them, and pools of connections to the others
+var peerRing hashRing
+var peerSelf string
+var peerPools = make(map[string]*pool.Pool)
+var peersLock sync.RWMutex
+
+// Each peer has this many points on the ring
+var peerVirtualNodes = 160
+
+// How often the peers are looked up in DNS
+var peerRefreshInterval = 5 * time.Second
+
+var peersStop chan bool
+var peersDone sync.WaitGroup
+
+// peerInvalidation is the keys written through this proxy (or all of them).
+type peerInvalidation struct {
+	keys []string
+	all  bool
+}
+
+// Invalidations waiting to be sent to the peers (in batches, off the
+// clients' round trips), and whether a write found the queue full, when
+// every key is evicted from the peers instead
+const maxQueuedPeerInvalidations = 1000
+
+var peerInvalidations = make(chan peerInvalidation, maxQueuedPeerInvalidations)
+var peerInvalidationsDropped int32
+
+// startPeers fills misses from the peers listed, and those found from the
+// DNS name (host:port), which is looked up again until stopPeers is called.
+// If self is empty, this proxy is the peer at one of its own addresses.
+func startPeers(static []string, dnsName string, self string, portStr string, size int) {
+
+	var current []string
+	refresh := func() {
+		addrs, err := resolvePeers(static, dnsName)
+		if err != nil {
+			log.Printf("Error looking up peers '%s' error: %s\n", dnsName, err)
+			return
+		}
+		if current != nil && reflect.DeepEqual(addrs, current) {
+			return
+		}
+		current = addrs
+		me := self
+		if me == "" {
+			me = localPeer(addrs, portStr)
+		}
+		log.Printf("Filling from peers: %s (as '%s')\n", strings.Join(addrs, ","), me)
+		setPeers(addrs, me, size)
+	}
+	refresh()
+
+	stop := make(chan bool)
+	peersStop = stop
+	peersDone.Add(1)
+	go func() {
+		defer peersDone.Done()
+		sendPeerInvalidations(stop)
+	}()
+	if dnsName == "" {
+		return
+	}
+
+	peersDone.Add(1)
+	go func() {
+		defer peersDone.Done()
+		ticker := time.NewTicker(peerRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+}
+
+func stopPeers() {
+
+	if peersStop != nil {
+		close(peersStop)
+		peersStop = nil
+		peersDone.Wait()
+	}
+	setPeers(nil, "", 0)
+	for len(peerInvalidations) > 0 {
+		<-peerInvalidations
+	}
+	atomic.StoreInt32(&peerInvalidationsDropped, 0)
+}
+
+// resolvePeers returns the peers listed and found from the DNS name, in order.
+func resolvePeers(static []string, dnsName string) ([]string, error) {
+
+	addrs := append([]string(nil), static...)
+	if dnsName != "" {
+		host, port, err := net.SplitHostPort(dnsName)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+
+	sort.Strings(addrs)
+	unique := addrs[:0]
+	for i, addr := range addrs {
+		if i == 0 || addr != addrs[i-1] {
+			unique = append(unique, addr)
+		}
+	}
+	return unique, nil
+}
+
+// localPeer returns the peer at one of this host's addresses (or its
+// name) and the port listened on, if any is.
+func localPeer(addrs []string, portStr string) string {
+
+	local := make(map[string]bool)
+	if hostname, err := os.Hostname(); err == nil {
+		local[hostname] = true
+	}
+	if ifaddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, ifaddr := range ifaddrs {
+			if ipnet, ok := ifaddr.(*net.IPNet); ok {
+				local[ipnet.IP.String()] = true
+			}
+		}
+	}
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil && port == portStr && local[host] {
+			return addr
+		}
+	}
+	return ""
+}
+
+// setPeers places the peers on the ring, opening pools of connections to
+// any new ones (which may not be up yet) and closing those to any gone.
+func setPeers(addrs []string, self string, size int) {
+
+	peersLock.RLock()
+	current := peerPools
+	peersLock.RUnlock()
+
+	pools := make(map[string]*pool.Pool)
+	weights := make([]int, len(addrs))
+	for i, addr := range addrs {
+		weights[i] = 1
+		if addr == self {
+			continue
+		}
+		if p, ok := current[addr]; ok {
+			pools[addr] = p
+			continue
+		}
+		p, err := createPeerPool(addr, size)
+		if err != nil {
+			log.Printf("Error on peer connection to '%s' error: %s\n", addr, err)
+		}
+		pools[addr] = p
+	}
+
+	peersLock.Lock()
+	peerRing, peerSelf, peerPools = newHashRing(addrs, weights, peerVirtualNodes), self, pools
+	peersLock.Unlock()
+
+	for addr, p := range current {
+		if pools[addr] != p {
+			p.Empty()
+		}
+	}
+}
+
+func currentPeers() (hashRing, string) {
+
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+
+	return peerRing, peerSelf
+}
+
+// createPeerPool creates a pool of connections to the peer, named as a peer's.
+func createPeerPool(addr string, size int) (*pool.Pool, error) {
+
+	dial := upstreamDialer()
+	return pool.NewCustom("tcp", addr, size, func(network, addr string) (*redis.Client, error) {
+		client, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.Cmd("CLIENT", "SETNAME", peerClientName).Err; err != nil {
+			client.Close()
+			return nil, err
+		}
+		return client, nil
+	})
+}
+
+// peerFetch sends the cache misses for keys owned by other peers to them
+// (where each is cached, so fetched upstream once for the tier), and the
+// rest of the commands upstream.
+func (p *upstreamPipeline) peerFetch(ring hashRing, self string) ([]respValue, bool) {
+
+	// Forwarded commands (such as writes) and those without keys (such
+	// as PING) always go upstream
+	var misses, others upstreamPipeline
+	var missed, other []int
+	others.primaryOnly = p.primaryOnly
+	for i, c := range p.cmds {
+		if k, _ := redis.KeyFromArgs(c.args...); c.forwarded || k == "" {
+			others.cmds = append(others.cmds, c)
+			others.forwarded = others.forwarded || c.forwarded
+			other = append(other, i)
+		} else {
+			misses.cmds = append(misses.cmds, c)
+			missed = append(missed, i)
+		}
+	}
+
+	resps := make([]respValue, len(p.cmds))
+	sent := false
+	if len(misses.cmds) > 0 {
+		missResps, missSent := misses.splitFetch(ring.node, func(key string, cmds []nodeCmd) ([]respValue, bool) {
+			return fetchFromPeer(ring.node(key), self, upstreamCmds(cmds))
+		})
+		for j, i := range missed {
+			resps[i] = missResps[j]
+		}
+		sent = missSent
+	}
+	if len(others.cmds) > 0 {
+		otherResps, otherSent := others.upstreamFetch()
+		for j, i := range other {
+			resps[i] = otherResps[j]
+		}
+		sent = sent || otherSent
+	}
+	return resps, sent
+}
+
+// fetchFromPeer pipelines the commands to the peer, unless it is this proxy
+// (or can't be reached), when they are sent upstream instead.
+func fetchFromPeer(peer string, self string, cmds []upstreamCmd) ([]respValue, bool) {
+
+	peersLock.RLock()
+	p := peerPools[peer]
+	peersLock.RUnlock()
+
+	if peer != self && p != nil {
+		resps, sent := fetchFrom(p, cmds)
+		if !connectionFailed(resps) {
+			// Not counting the TTLs fetched alongside the misses
+			for _, c := range cmds {
+				if c.cmd != "PTTL" {
+					peerFills.Add(1)
+				}
+			}
+			return resps, sent
+		}
+	}
+	local := upstreamPipeline{cmds: cmds}
+	return local.upstreamFetch()
+}
+
+// invalidatePeers queues the keys written through this proxy (or, if all,
+// every key) to be evicted from the other peers owning them, which would
+// otherwise keep filling misses for them with their old values.
+func invalidatePeers(keys []string, all bool) {
+
+	if ring, _ := currentPeers(); ring == nil {
+		return
+	}
+	select {
+	case peerInvalidations <- peerInvalidation{keys, all}:
+	default:
+		atomic.StoreInt32(&peerInvalidationsDropped, 1)
+	}
+}
+
+// sendPeerInvalidations sends the queued invalidations to the peers, those
+// queued meanwhile together, until stopped.
+func sendPeerInvalidations(stop chan bool) {
+
+	for {
+		var batch peerInvalidation
+		select {
+		case <-stop:
+			return
+		case batch = <-peerInvalidations:
+		}
+	queued:
+		for !batch.all {
+			select {
+			case next := <-peerInvalidations:
+				batch.keys = append(batch.keys, next.keys...)
+				batch.all = next.all
+			default:
+				break queued
+			}
+		}
+		if atomic.SwapInt32(&peerInvalidationsDropped, 0) == 1 {
+			log.Printf("Peer invalidations fell %d behind, evicting every key from the peers\n", maxQueuedPeerInvalidations)
+			batch.all = true
+		}
+		sendPeerInvalidation(batch.keys, batch.all)
+	}
+}
+
+// sendPeerInvalidation evicts the keys (or, if all, every key) from the
+// other peers owning them.
+func sendPeerInvalidation(keys []string, all bool) {
+
+	ring, self := currentPeers()
+	if ring == nil {
+		return
+	}
+
+	peersLock.RLock()
+	owned := make(map[string][]interface{})
+	for peer := range peerPools {
+		if all {
+			owned[peer] = nil
+		}
+	}
+	pools := peerPools
+	peersLock.RUnlock()
+
+	for _, key := range keys {
+		if peer := ring.node(key); peer != self && !all {
+			owned[peer] = append(owned[peer], key)
+		}
+	}
+	for peer, args := range owned {
+		p := pools[peer]
+		if p == nil {
+			continue
+		}
+		resps, _ := fetchFrom(p, []upstreamCmd{{cmd: peerInvalidate, args: args}})
+		if resps[0].isError() {
+			log.Printf("Error invalidating keys on peer '%s' error: %s\n", peer, resps[0].str)
+		}
+	}
+}
+
+// invalidateFromPeer evicts the keys written through another peer.
+func invalidateFromPeer(args [][]byte) respValue {
+
+	if len(args) == 1 {
+		invalidateAll()
+		return respSimple("OK")
+	}
+	keys := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		keys[i] = string(arg)
+	}
+	invalidateKeys(keys...)
+	return respSimple("OK")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startStandInPeer starts a stand-in peer whose GETs return 'fromPeer',
+// and which fails any other commands (which should go upstream).
+func startStandInPeer(t *testing.T) *standIn {
+
+	return startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "GET":
+			return []respValue{respBulk([]byte("fromPeer"))}
+		case "CLIENT", "PING", peerInvalidate:
+			return []respValue{respSimple("OK")}
+		}
+		return []respValue{respErr("ERR not the upstream")}
+	})
+}
+
+// ownedKey returns a key (starting with the prefix) owned by the node.
+func ownedKey(ring hashRing, node string, prefix string) string {
+
+	for i := 0; ; i++ {
+		key := prefix + strconv.Itoa(i)
+		if ring.node(key) == node {
+			return key
+		}
+	}
+}
+
+func TestPeerFill(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	upstream := startNamedUpstream(t, "localhost:0", "fromUpstream")
+	defer upstream.close()
+	upstreamPool, err := createRedisPool(upstream.addr(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamPool.Empty()
+	backendPool := redisPool
+	redisPool = upstreamPool
+	defer func() { redisPool = backendPool }()
+
+	peer := startStandInPeer(t)
+	defer peer.close()
+
+	startPeers([]string{"self:6379", peer.addr()}, "", "self:6379", "", 2)
+	defer stopPeers()
+	ring, _ := currentPeers()
+
+	// Misses for keys the peer owns are filled from it, on connections named as a peer's
+	fills := peerFills.Value()
+	if val, err := getRedisValue(ownedKey(ring, peer.addr(), "peerKey")); val != "fromPeer" || err != nil {
+		t.Errorf("Expected 'fromPeer'. Got '%s' and %v", val, err)
+	}
+	peer.waitFor(t, "CLIENT")
+	if val, err := getRedisValue(ownedKey(ring, "self:6379", "selfKey")); val != "fromUpstream" || err != nil {
+		t.Errorf("Expected 'fromUpstream'. Got '%s' and %v", val, err)
+	}
+	vals, errs := getRedisMultiValues([]string{ownedKey(ring, peer.addr(), "peerMulti"), ownedKey(ring, "self:6379", "selfMulti")})
+	for i, expected := range []string{"fromPeer", "fromUpstream"} {
+		if vals[i] != expected || errs[i] != nil {
+			t.Errorf("Expected '%s'. Got '%s' and %v", expected, vals[i], errs[i])
+		}
+	}
+	if n := peerFills.Value() - fills; n != 2 {
+		t.Errorf("Expected 2 misses filled from the peer. Got %d", n)
+	}
+
+	// Writes go upstream (evicting the keys from the peers owning them), as do misses for a peer
+	key := ownedKey(ring, peer.addr(), "peerWrite")
+	request := "SET " + key + " value\r\nCLIENT SETNAME " + peerClientName + "\r\nGET " + key + "\r\n"
+	if buf := sendTCP(t, request+quitRequest); string(buf) != "+OK\r\n+OK\r\n$12\r\nfromUpstream\r\n+OK\r\n" {
+		t.Errorf("Expected '+OK\\r\\n+OK\\r\\n$12\\r\\nfromUpstream\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+	peer.waitFor(t, peerInvalidate)
+
+	// Likewise, peers evict the keys written through them from this proxy
+	if _, found := getCachedValue(key); !found {
+		t.Fatalf("Expected '%s' to be cached", key)
+	}
+	request = "CLIENT SETNAME " + peerClientName + "\r\n" + peerInvalidate + " " + key + "\r\n"
+	if buf := sendTCP(t, request+quitRequest); string(buf) != "+OK\r\n+OK\r\n+OK\r\n" {
+		t.Errorf("Expected '+OK\\r\\n+OK\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+	if _, found := getCachedValue(key); found {
+		t.Errorf("Expected '%s' to be evicted", key)
+	}
+
+	// If the peer can't be reached, the upstream is read instead
+	peer.close()
+	if val, err := getRedisValue(ownedKey(ring, peer.addr(), "peerDown")); val != "fromUpstream" || err != nil {
+		t.Errorf("Expected 'fromUpstream'. Got '%s' and %v", val, err)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestPeerInvalidationQueue(t *testing.T) {
+
+	// A peer which is slow to evict keys
+	received, release := make(chan bool, 10), make(chan bool)
+	evicted := make(chan int, 10)
+	peer := startStandIn(t, func(args [][]byte) []respValue {
+		if strings.ToUpper(string(args[0])) == peerInvalidate {
+			received <- true
+			<-release
+			evicted <- len(args) - 1
+		}
+		return []respValue{respSimple("OK")}
+	})
+	defer peer.close()
+
+	startPeers([]string{"self:6379", peer.addr()}, "", "self:6379", "", 2)
+	defer stopPeers()
+	ring, _ := currentPeers()
+
+	// Doesn't hold up writes through this proxy
+	key := ownedKey(ring, peer.addr(), "slowPeer")
+	defer redisPool.Cmd("DEL", key)
+	start := time.Now()
+	if buf := sendTCP(t, "SET "+key+" value\r\n"+quitRequest); string(buf) != "+OK\r\n+OK\r\n" {
+		t.Errorf("Expected '+OK\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the write not to wait for the peer. Took %v", elapsed)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the peer to be sent the write's key")
+	}
+
+	// And once too many writes are waiting, every key is evicted from it
+	for i := 0; i <= maxQueuedPeerInvalidations; i++ {
+		invalidatePeers([]string{key}, false)
+	}
+	close(release)
+	for i, expected := range []int{1, 0} {
+		select {
+		case n := <-evicted:
+			if n != expected {
+				t.Errorf("Expected eviction %d of %d keys. Got %d", i, expected, n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected eviction %d", i)
+		}
+	}
+}
+
+func TestResolvePeers(t *testing.T) {
+
+	addrs, err := resolvePeers([]string{"peer-b:6379", "peer-a:6379", "peer-b:6379"}, "localhost:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) < 3 || !reflect.DeepEqual(addrs[len(addrs)-2:], []string{"peer-a:6379", "peer-b:6379"}) {
+		t.Errorf("Expected the peers to be sorted, once each. Got %q", addrs)
+	}
+	found := false
+	for _, addr := range addrs {
+		found = found || addr == "127.0.0.1:6379"
+	}
+	if !found {
+		t.Errorf("Expected '127.0.0.1:6379' from DNS. Got %q", addrs)
+	}
+
+	peers := []string{"192.0.2.1:5000", "127.0.0.1:5000"}
+	if self := localPeer(peers, "5000"); self != "127.0.0.1:5000" {
+		t.Errorf("Expected '127.0.0.1:5000'. Got '%s'", self)
+	}
+	if self := localPeer(peers, "5001"); self != "" {
+		t.Errorf("Expected no peer. Got '%s'", self)
+	}
+}
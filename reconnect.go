@@ -0,0 +1,75 @@
+// reconnect handles the recovery from lost upstream connections, retrying with exponential backoff and jitter.
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// The number of times a failed round trip to the upstream is retried
+var upstreamRetries = 3
+
+// The delay before the first retry, which doubles with each retry after
+var retryDelay = 50 * time.Millisecond
+
+// Backoffs stop doubling at this many times their first delay
+const maxBackoffFactor = 32
+
+// Set while the upstream is unreachable (as the proxy is then degraded)
+var upstreamDown int32
+
+// backoff returns the delay before the given retry (counting from 0).
+// Half of it is random, so that proxies which lost the same upstream
+// (say, in a rolling restart) don't all reconnect at once.
+func backoff(delay time.Duration, retry int) time.Duration {
+
+	for i := 0; i < retry && i < 5; i++ {
+		delay *= 2
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// connectionFailed reports whether any of the upstream replies failed
+// because of the connection (rather than being a Redis error).
+func connectionFailed(replies []respValue) bool {
+
+	for _, reply := range replies {
+		if reply.err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// drainPool closes the idle upstream connections after one has failed,
+// as they are likely to have been lost with it.
+func drainPool(upstream upstreamPool) {
+
+	for n := upstream.Avail(); n > 0; n-- {
+		client, err := upstream.Get()
+		if err != nil {
+			return
+		}
+		client.Close()
+	}
+}
+
+// noteUpstream records whether the upstream could be reached, logging
+// when the proxy is degraded or recovers.
+func noteUpstream(ok bool) {
+
+	if ok {
+		if atomic.SwapInt32(&upstreamDown, 0) == 1 {
+			log.Println("Upstream reconnected")
+		}
+		return
+	}
+	if atomic.SwapInt32(&upstreamDown, 1) == 0 {
+		log.Println("Upstream unavailable, serving cached values only")
+	}
+}
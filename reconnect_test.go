@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1600, 3200, 3200, 3200} {
+		for i := 0; i < 100; i++ {
+			if delay := backoff(100, retry); delay < max/2 || delay >= max {
+				t.Fatalf("Expected retry %d to back off from %d to %d. Got %d", retry, max/2, max, delay)
+			}
+		}
+	}
+}
+
+// startCountingUpstream starts a stand-in upstream which counts the SETs it receives.
+func startCountingUpstream(t *testing.T, addr string, sets *int64) *standIn {
+
+	return startStandInAt(t, addr, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "GET":
+			return []respValue{respBulk([]byte("value"))}
+		case "PING":
+			return []respValue{respSimple("PONG")}
+		case "SET":
+			atomic.AddInt64(sets, 1)
+		}
+		return []respValue{respSimple("OK")}
+	})
+}
+
+func TestUpstreamReconnect(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = delay }()
+
+	var sets int64
+	upstream := startCountingUpstream(t, "localhost:0", &sets)
+	addr := upstream.addr()
+	defer func() { upstream.close() }()
+
+	upstreamPool, err := createRedisPool(addr, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamPool.Empty()
+
+	backendPool := redisPool
+	redisPool = upstreamPool
+	defer func() { redisPool = backendPool }()
+
+	// Reads are retried on new connections, but sent writes aren't repeated
+	upstream.drop()
+	if val, err := getRedisValue("lostKey"); val != "value" || err != nil {
+		t.Errorf("Expected 'value'. Got '%s' and %v", val, err)
+	}
+	upstream.drop()
+	buf := sendTCP(t, "SET lostKey value\r\n"+quitRequest)
+	if message := string(buf); message != "-ERR upstream unavailable\r\n+OK\r\n" {
+		t.Errorf("Expected '-ERR upstream unavailable\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+	if n := atomic.LoadInt64(&sets); n != 0 {
+		t.Errorf("Expected no SETs. Got %d", n)
+	}
+
+	// Degraded while the upstream is down, and not afterwards
+	upstream.close()
+	redisCache.lru.Purge()
+	if _, err := getRedisValue("lostKey"); err != errUpstreamUnavailable {
+		t.Errorf("Expected '%s'. Got %v", errUpstreamUnavailable, err)
+	}
+	checkHealth(t, http.StatusServiceUnavailable, "DEGRADED")
+
+	upstream = startCountingUpstream(t, addr, &sets)
+	checkHealth(t, http.StatusOK, "PONG")
+	if val, err := getRedisValue("lostKey"); val != "value" || err != nil {
+		t.Errorf("Expected 'value'. Got '%s' and %v", val, err)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func checkHealth(t *testing.T, code int, status string) {
+
+	req, err := http.NewRequest("GET", "/ping", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest: %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, code, response.Code)
+
+	if body := response.Body.String(); body != status {
+		t.Errorf("Expected '%s'. Got '%s'", status, body)
+	}
+}
@@ -1,20 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/mediocregopher/radix.v2/pool"
 	"github.com/mediocregopher/radix.v2/redis"
 )
 
-var redisClient *redis.Client
+// upstreamPool is a pool of connections to the upstream Redis (or to
+// its current master, when found through Sentinel).
+type upstreamPool interface {
+	Get() (*redis.Client, error)
+	Put(client *redis.Client)
+	Cmd(cmd string, args ...interface{}) *redis.Resp
+	Avail() int
+	Empty()
+}
+
+// The pool pings idle connections, and replaces those which fail
+var redisPool upstreamPool
 
 type lockableCache struct {
 	// lru.Cache is threadsafe but it is exported
@@ -23,44 +40,158 @@ type lockableCache struct {
 	//  need to lock the cache as a whole.
 	lru  *lru.Cache
 	lock *sync.RWMutex
+
+	// Indexes the cached replies by Redis key, so that
+	//  all of them can be invalidated when it changes.
+	keys     map[string]map[cacheKey]bool
+	keysLock *sync.Mutex
 }
 
 var redisCache lockableCache
 
+// TCP client connections idle for longer than idleTimeout are closed
+// (zero means idle connections are never closed).
+var idleTimeout time.Duration
+
 var expiryStop chan bool
 
-var cacheHit int  // not threadsafe, purely for testing
-var cacheMiss int // not threadsafe, purely for testing
+var cacheHit int64  // purely for testing
+var cacheMiss int64 // purely for testing
+
+var upstreamFetch int64 // purely for testing
 
 func clearCacheStats() {
 
-	cacheHit = 0
-	cacheMiss = 0
+	atomic.StoreInt64(&cacheHit, 0)
+	atomic.StoreInt64(&cacheMiss, 0)
+	atomic.StoreInt64(&upstreamFetch, 0)
+}
+
+// cacheKey identifies a cached reply: the Redis key it was read
+// from, plus the read command (and any other arguments) used.
+type cacheKey struct {
+	key  string
+	cmd  string
+	args string // any other arguments, RESP-encoded
 }
 
+// valueStruct holds a cached reply, as sent to clients.
 type valueStruct struct {
-	value      string
-	expiryTime int64
+	value      respValue
+	expiryTime int64 // accessed atomically, as hits touch it in place
+	deadline   int64 // when the key expires upstream (0 if it doesn't)
+}
+
+func getCacheKey(key string) cacheKey {
+
+	return cacheKey{key: key, cmd: "GET"}
 }
 
 func healthCheck(w http.ResponseWriter, req *http.Request) {
 
-	res, err := redisClient.Cmd("PING").Str()
-	if err != nil {
-		log.Fatal("healthCheck error: ", err)
-	}
+	// The health of the primary is checked (replicas are checked apart)
+	p := upstreamPipeline{primaryOnly: true}
+	p.add("PING")
+	resps := p.run()
+	p.finish()
+
+	// The proxy is degraded (serving only cached values) until reconnected
 	w.Header().Set("Content-Type", "text/plain")
+	if resps[0].kind != respSimpleString {
+		log.Println("healthCheck error:", string(resps[0].str))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "DEGRADED")
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, res)
+	fmt.Fprint(w, string(resps[0].str))
 }
 
 func createLockableCache(size int) lockableCache {
 
-	lruCache, err := lru.New(size)
+	cache := lockableCache{
+		lock:     new(sync.RWMutex),
+		keys:     make(map[string]map[cacheKey]bool),
+		keysLock: new(sync.Mutex),
+	}
+	lruCache, err := lru.NewWithEvict(size, func(key interface{}, value interface{}) {
+		// Replies dropped (as they expire, or to make room) rather than
+		// invalidated are invalidated for the clients tracking their keys,
+		// whose own caches would otherwise keep them indefinitely
+		ck := key.(cacheKey)
+		if cache.unindex(ck) {
+			broadcastInvalidation([]string{ck.key}, false)
+		}
+	})
 	if err != nil {
 		log.Fatal("Could not create 'redis' cache, err: ", err)
 	}
-	return lockableCache{lru: lruCache, lock: new(sync.RWMutex)}
+	cache.lru = lruCache
+	return cache
+}
+
+// add caches a reply; the cache should always be added to this way.
+func (c lockableCache) add(ck cacheKey, entry *valueStruct) {
+
+	c.keysLock.Lock()
+	cached := c.keys[ck.key]
+	if cached == nil {
+		cached = make(map[cacheKey]bool)
+		c.keys[ck.key] = cached
+	}
+	cached[ck] = true
+	c.keysLock.Unlock()
+
+	c.lru.Add(ck, entry)
+}
+
+// remove evicts a cached reply which is being replaced or has already
+// been invalidated (so tracking clients aren't sent it again).
+func (c lockableCache) remove(ck cacheKey) {
+
+	c.unindex(ck)
+	c.lru.Remove(ck)
+}
+
+// purge evicts every cached reply, likewise.
+func (c lockableCache) purge() {
+
+	c.keysLock.Lock()
+	for key := range c.keys {
+		delete(c.keys, key)
+	}
+	c.keysLock.Unlock()
+
+	c.lru.Purge()
+}
+
+// unindex returns false if the reply was no longer indexed.
+func (c lockableCache) unindex(ck cacheKey) bool {
+
+	c.keysLock.Lock()
+	defer c.keysLock.Unlock()
+
+	if !c.keys[ck.key][ck] {
+		return false
+	}
+	delete(c.keys[ck.key], ck)
+	if len(c.keys[ck.key]) == 0 {
+		delete(c.keys, ck.key)
+	}
+	return true
+}
+
+// cachedReplies returns the cache keys of all of the replies cached for a Redis key.
+func (c lockableCache) cachedReplies(key string) []cacheKey {
+
+	c.keysLock.Lock()
+	defer c.keysLock.Unlock()
+
+	cks := make([]cacheKey, 0, len(c.keys[key]))
+	for ck := range c.keys[key] {
+		cks = append(cks, ck)
+	}
+	return cks
 }
 
 func startExpiryDaemon(timeout int, ms time.Duration) {
@@ -98,8 +229,11 @@ func expireRedisCache(ms int) {
 	keys := redisCache.lru.Keys()
 	for _, key := range keys {
 		//log.Printf("expireRedisCache key: %s\n", key)
-		cached, _ := redisCache.lru.Get(key)
-		expiry := cached.(*valueStruct).expiryTime
+		cached, found := redisCache.lru.Peek(key)
+		if !found {
+			continue
+		}
+		expiry := atomic.LoadInt64(&cached.(*valueStruct).expiryTime)
 		// Short-circuit if we no longer need to expire entries
 		if expiry > expiryTimeLimit {
 			break
@@ -111,9 +245,34 @@ func expireRedisCache(ms int) {
 
 func createRedisClient(addr string) (*redis.Client, error) {
 
+	return dialUpstream(addr, upstreamProtocol)
+}
+
+func dialUpstream(addr string, protocol int) (*redis.Client, error) {
+
+	if protocol == 3 {
+		return dialRESP3(addr, 5*time.Second)
+	}
 	return redis.DialTimeout("tcp", addr, 5*time.Second)
 }
 
+// upstreamDialer returns the dial function for a pool of upstream
+// connections, which keep to the protocol the pool was created with.
+func upstreamDialer() func(network, addr string) (*redis.Client, error) {
+
+	protocol := upstreamProtocol
+	return func(network, addr string) (*redis.Client, error) {
+		return dialUpstream(addr, protocol)
+	}
+}
+
+// createRedisPool creates a pool of upstream connections, keeping up to
+// 'size' idle connections (more are created as needed).
+func createRedisPool(addr string, size int) (*pool.Pool, error) {
+
+	return pool.NewCustom("tcp", addr, size, upstreamDialer())
+}
+
 func createRouter() *mux.Router {
 
 	router := mux.NewRouter()
@@ -121,6 +280,12 @@ func createRouter() *mux.Router {
 	// Health Check
 	router.HandleFunc("/ping", healthCheck).Methods("GET")
 
+	// Metrics (such as collapsedRequests)
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+
+	// Redis MGET
+	router.HandleFunc("/", getRedisMulti).Methods("GET").Queries("key", "")
+
 	// Redis GET
 	router.HandleFunc("/{key}", getRedis).Methods("GET")
 
@@ -129,36 +294,360 @@ func createRouter() *mux.Router {
 
 func getRedisValue(key string) (string, error) {
 
-	cached, found := redisCache.lru.Get(key)
-	if found {
-		val := cached.(*valueStruct).value
+	vals, errs := getRedisValues([]string{key})
+	return vals[0], errs[0]
+}
 
-		// Touch cache entry expiry timer
-		redisCache.lock.Lock()
-		redisCache.lru.Remove(key)
-		entry := &valueStruct{val, time.Now().UnixNano()}
-		redisCache.lru.Add(key, entry)
-		redisCache.lock.Unlock()
+// getRedisValues looks up each key in the cache, fetching all of
+// the misses from Redis in a single pipelined round trip.
+func getRedisValues(keys []string) ([]string, []error) {
 
-		cacheHit++
-		return val, nil
+	vals, misses := getCachedValues(keys)
+	errs := make([]error, len(keys))
+
+	var p upstreamPipeline
+	fetches, joined, led := joinFlights(keys, misses)
+	for j, i := range fetches {
+		p.add("GET", keys[i])
+		p.lead(led[j], getCacheKey(keys[i]), -1)
 	}
-	cacheMiss++
-	val, err := redisClient.Cmd("GET", key).Str()
-	if err == redis.ErrRespNil {
-		return "", redis.ErrRespNil
+
+	resps := p.run()
+	for j, i := range fetches {
+		vals[i], errs[i] = cacheRedisValue(keys[i], resps[j], p.deadline(keys[i]))
+	}
+	p.finish()
+	for i, f := range joined {
+		vals[i], errs[i] = redisValue(keys[i], f.wait())
+	}
+	return vals, errs
+}
+
+// getRedisMultiValues looks up each key in the cache, fetching all
+// of the misses from Redis with a single MGET.
+func getRedisMultiValues(keys []string) ([]string, []error) {
+
+	vals, misses := getCachedValues(keys)
+	errs := make([]error, len(keys))
+	if len(misses) == 0 {
+		return vals, errs
+	}
+
+	var p upstreamPipeline
+	fetches, joined, led := joinFlights(keys, misses)
+	if len(fetches) > 0 {
+		p.add("MGET", mgetArgs(keys, fetches)...)
+		for j, i := range fetches {
+			p.lead(led[j], getCacheKey(keys[i]), j)
+		}
+	}
+
+	resps := p.run()
+	if len(fetches) > 0 {
+		cacheRedisMultiValues(keys, fetches, resps[0], p.deadline, vals, errs)
 	}
+	p.finish()
+	for i, f := range joined {
+		vals[i], errs[i] = redisValue(keys[i], f.wait())
+	}
+	return vals, errs
+}
+
+// getCachedValues looks up each key in the cache, returning
+// the values found and the indexes of the keys which missed.
+func getCachedValues(keys []string) ([]string, []int) {
+
+	vals := make([]string, len(keys))
+
+	var misses []int
+	for i, key := range keys {
+		val, found := getCachedValue(key)
+		if found {
+			atomic.AddInt64(&cacheHit, 1)
+			vals[i] = val
+			continue
+		}
+		atomic.AddInt64(&cacheMiss, 1)
+		misses = append(misses, i)
+	}
+	return vals, misses
+}
+
+func mgetArgs(keys []string, misses []int) []interface{} {
+
+	args := make([]interface{}, len(misses))
+	for j, i := range misses {
+		args[j] = keys[i]
+	}
+	return args
+}
+
+// cacheRedisValue caches the upstream reply to a GET of 'key', until
+// the deadline (if any) when the key expires upstream.
+func cacheRedisValue(key string, reply respValue, deadline int64) (string, error) {
+
+	val, err := redisValue(key, reply)
 	if err != nil {
-		log.Printf("getRedisValue for key '%s', error: %s\n", key, err)
 		return "", err
 	}
 
 	// Update caching
-	entry := &valueStruct{val, time.Now().UnixNano()}
-	redisCache.lru.Add(key, entry)
+	entry := &valueStruct{respBulk([]byte(val)), time.Now().UnixNano(), deadline}
+	redisCache.add(getCacheKey(key), entry)
 	return val, nil
 }
 
+// redisValue returns the value from the upstream reply to a GET of 'key'.
+func redisValue(key string, reply respValue) (string, error) {
+
+	if reply.null {
+		return "", redis.ErrRespNil
+	}
+	if reply.kind != respBulkString && reply.kind != respSimpleString {
+		log.Printf("redisValue for key '%s', error: %s\n", key, reply.str)
+		return "", upstreamError(reply)
+	}
+	return string(reply.str), nil
+}
+
+// cacheRedisReply caches the upstream reply to a read command (until
+// the deadline, if any), returning the reply to send to the client.
+func cacheRedisReply(ck cacheKey, reply respValue, deadline int64) respValue {
+
+	if reply.isError() {
+		log.Printf("cacheRedisReply for %s of key '%s', error: %s\n", ck.cmd, ck.key, reply.str)
+	}
+	if reply.isError() || reply.null {
+		return reply
+	}
+
+	// Update caching
+	entry := &valueStruct{reply, time.Now().UnixNano(), deadline}
+	redisCache.add(ck, entry)
+	return reply
+}
+
+// cacheRedisMultiValues caches the upstream reply to an MGET of the
+// keys which missed (each until its deadline), merging the results
+// into vals and errs.
+func cacheRedisMultiValues(keys []string, misses []int, reply respValue, deadline func(key string) int64, vals []string, errs []error) {
+
+	elems := reply.elems
+	if reply.kind != respArray || reply.null || len(elems) != len(misses) {
+		err := upstreamError(reply)
+		log.Printf("cacheRedisMultiValues for %d keys, error: %s\n", len(misses), err)
+		for _, i := range misses {
+			errs[i] = err
+		}
+		return
+	}
+
+	for j, i := range misses {
+		vals[i], errs[i] = cacheRedisValue(keys[i], elems[j], deadline(keys[i]))
+	}
+}
+
+func getCachedValue(key string) (string, bool) {
+
+	val, found := getCachedReply(getCacheKey(key))
+	return string(val.str), found
+}
+
+func getCachedReply(ck cacheKey) (respValue, bool) {
+
+	// Get makes the entry the most recently used
+	cached, found := redisCache.lru.Get(ck)
+	if !found {
+		return respValue{}, false
+	}
+	entry := cached.(*valueStruct)
+
+	// The key has since expired upstream
+	if expired(entry.deadline) {
+		redisCache.lru.Remove(ck)
+		return respValue{}, false
+	}
+
+	// Touch cache entry expiry timer. This is done in place, as
+	// re-adding the entry could revive one just invalidated.
+	atomic.StoreInt64(&entry.expiryTime, time.Now().UnixNano())
+
+	return entry.value, true
+}
+
+// upstreamPipeline batches commands into a single round trip to Redis.
+type upstreamPipeline struct {
+	cmds        []upstreamCmd
+	flights     []ledFlight
+	forwarded   bool // which may not be safe to repeat
+	fromPeer    bool // so misses are only sent upstream, never to another peer
+	primaryOnly bool // rather than a replica, even if not forwarded
+	deadlines   map[string]int64
+}
+
+type upstreamCmd struct {
+	cmd       string
+	args      []interface{}
+	forwarded bool
+}
+
+// ledFlight is a flight to land with the reply to one of the commands
+// (or, for MGET, with one element of the reply).
+type ledFlight struct {
+	f    *flight
+	ck   cacheKey
+	cmd  int
+	elem int // -1 for the whole reply
+}
+
+func (p *upstreamPipeline) add(cmd string, args ...interface{}) {
+
+	p.cmds = append(p.cmds, upstreamCmd{cmd: cmd, args: args})
+}
+
+// forward adds a command passed through from a client (such as a write).
+func (p *upstreamPipeline) forward(cmd string, args ...interface{}) {
+
+	p.cmds = append(p.cmds, upstreamCmd{cmd: cmd, args: args, forwarded: true})
+	p.forwarded = true
+}
+
+// lead lands the flight with the reply to the last command added.
+func (p *upstreamPipeline) lead(f *flight, ck cacheKey, elem int) {
+
+	p.flights = append(p.flights, ledFlight{f, ck, len(p.cmds) - 1, elem})
+}
+
+// run sends all of the commands to Redis together, returning their replies
+// in order. Once the replies have been cached, finish must be called.
+func (p *upstreamPipeline) run() []respValue {
+
+	if len(p.cmds) == 0 {
+		return nil
+	}
+
+	startFill(p)
+	atomic.AddInt64(&upstreamFetch, 1)
+
+	// The remaining TTLs of the keys read are fetched alongside them
+	n := len(p.cmds)
+	ttlKeys := p.addTTLs()
+	resps, sent := p.route()
+
+	// Forwarded commands are only retried if they weren't sent at all
+	for retry := 0; retry < upstreamRetries && connectionFailed(resps) && (!sent || !p.forwarded); retry++ {
+		time.Sleep(backoff(retryDelay, retry))
+		resps, sent = p.route()
+	}
+	noteUpstream(!connectionFailed(resps))
+	p.noteTTLs(ttlKeys, resps[n:])
+	p.cmds, resps = p.cmds[:n], resps[:n]
+
+	// Waiting cache misses only need the replies, so aren't held up
+	for _, l := range p.flights {
+		reply := resps[l.cmd]
+		if l.elem >= 0 && reply.kind == respArray && l.elem < len(reply.elems) {
+			reply = reply.elems[l.elem]
+		}
+		l.f.land(l.ck, reply)
+	}
+	return resps
+}
+
+// route sends cache misses to the peer owning their keys, if filling
+// from peers, and otherwise upstream.
+func (p *upstreamPipeline) route() ([]respValue, bool) {
+
+	if !p.fromPeer {
+		if ring, self := currentPeers(); ring != nil {
+			return p.peerFetch(ring, self)
+		}
+	}
+	return p.upstreamFetch()
+}
+
+// upstreamFetch sends cache misses to a healthy replica (if any), failing
+// over to the primary, which forwarded commands (such as writes) and
+// misses for keys written recently always go to.
+func (p *upstreamPipeline) upstreamFetch() ([]respValue, bool) {
+
+	if c, clustered := currentCluster(); clustered {
+		if c == nil {
+			return unavailable(errClusterConnecting, len(p.cmds)), false
+		}
+		return p.clusterFetch(c)
+	}
+	if shardRing != nil {
+		return p.shardFetch()
+	}
+	if !p.forwarded && !p.primaryOnly && !writtenRecently(p.cmds) {
+		if r := pickReplica(); r != nil {
+			resps, sent := p.fetch(r.pool)
+			if !connectionFailed(resps) {
+				return resps, sent
+			}
+			r.note(false)
+		}
+	}
+	return p.fetch(redisPool)
+}
+
+// fetch makes a single attempt at the round trip, also returning
+// whether the commands were sent (as they may then have been run).
+func (p *upstreamPipeline) fetch(upstream upstreamPool) ([]respValue, bool) {
+
+	return fetchFrom(upstream, p.cmds)
+}
+
+func fetchFrom(upstream upstreamPool, cmds []upstreamCmd) ([]respValue, bool) {
+
+	client, err := upstream.Get()
+	if err != nil {
+		return unavailable(err, len(cmds)), false
+	}
+	// Failed connections are closed, so are not put back
+	defer upstream.Put(client)
+
+	resps := roundTrip(client, cmds)
+	if client.LastCritical != nil {
+		drainPool(upstream)
+	}
+	return resps, true
+}
+
+// roundTrip pipelines the commands over the client's connection,
+// returning the replies as Redis sent them.
+func roundTrip(client *redis.Client, cmds []upstreamCmd) []respValue {
+
+	if rc := resp3ConnOf(client); rc != nil {
+		return rc.roundTrip(client, cmds)
+	}
+	for _, c := range cmds {
+		client.PipeAppend(c.cmd, c.args...)
+	}
+	resps := make([]respValue, len(cmds))
+	for i := range resps {
+		resps[i] = respFromRadix(client.PipeResp())
+	}
+	return resps
+}
+
+// unavailable returns n replies for an upstream which couldn't be reached.
+func unavailable(err error, n int) []respValue {
+
+	resps := make([]respValue, n)
+	for i := range resps {
+		resps[i] = respUnavailable(err)
+	}
+	return resps
+}
+
+// finish applies any invalidations which raced with the round trip.
+func (p *upstreamPipeline) finish() {
+
+	finishFill(p)
+}
+
 func startListener(portStr string) error {
 
 	nlr, err := net.Listen("tcp", ":"+portStr)
@@ -167,43 +656,58 @@ func startListener(portStr string) error {
 	}
 	defer nlr.Close()
 
-	log.Printf("Caching TCP redis proxy now listening on port " + portStr + "...\n")
+	log.Printf("Caching TCP redis proxy now listening on port %s...\n", portStr)
 
 	for {
 		conn, err := nlr.Accept()
 		if err != nil {
 			log.Println("startListener - error accepting 'tcp' connection:", err)
+			continue
 		}
 		log.Println("Accepted conn:", conn)
 		go handleRequest(conn)
 	}
 }
 
-var redisGet = regexp.MustCompile(`^\*\d+\r\n\$\d+\r\nGET\r\n\$\d+\r\n.*\r\n`)
-
 func handleRequest(conn net.Conn) {
 
 	defer conn.Close()
 
-	buf := make([]byte, 1024)
+	reader := bufio.NewReaderSize(conn, maxInlineLength)
+	client := newClientConn(conn)
+	client.register()
+	defer client.close()
 
-	length, err := conn.Read(buf)
-	if err != nil {
-		log.Println("Error reading:", err.Error())
-	}
-
-	if redisGet.Match(buf) {
+	// Serve commands until the client quits, disconnects or goes idle
+	for {
+		// As with Redis, subscribed clients are never idle
+		if idleTimeout > 0 && !client.subscribed {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
 
-		//log.Printf("Got redis request, length %d, '%s'\n", length, buf[:length])
+		reqs, err := readPipeline(reader)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Println("Closing idle connection:", conn.RemoteAddr())
+			} else if err != io.EOF {
+				log.Println("Error reading:", err.Error())
+			}
+		}
 
-		keyToGet := string(unwrapRedisKey(buf[:length]))
-		val, _ := getRedisValue(keyToGet)
-		conn.Write([]byte(wrapRedisValue(val)))
-		return
+		// Answer whatever arrived before any read error
+		quit := len(reqs) > 0 && serveCommands(client, reqs)
+		if err == errProtocol && !quit {
+			client.send(respErr("ERR Protocol error"))
+		}
+		if err == errUnbalancedQuotes && !quit {
+			client.send(respErr("ERR Protocol error: unbalanced quotes in request"))
+		}
+		if quit || err != nil {
+			return
+		}
 	}
-
-	log.Println("Got bad request: ", buf)
-	log.Println("Got bad request: ", string(buf))
 }
 
 func getRedis(w http.ResponseWriter, req *http.Request) {
@@ -217,11 +721,49 @@ func getRedis(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, val)
 }
 
+// getRedisMulti returns a JSON array of the values of the 'key'
+// query parameters, in order, with null for any missing keys.
+func getRedisMulti(w http.ResponseWriter, req *http.Request) {
+
+	keysToGet := req.URL.Query()["key"]
+	vals, errs := getRedisMultiValues(keysToGet)
+
+	values := make([]*string, len(keysToGet))
+	for i, err := range errs {
+		if err == redis.ErrRespNil {
+			continue
+		}
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+		values[i] = &vals[i]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(values)
+}
+
+func writeUpstreamError(w http.ResponseWriter, err error) {
+
+	w.Header().Set("Content-Type", "text/plain")
+	if err == errUpstreamUnavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	fmt.Fprint(w, err)
+}
+
 func main() {
 
 	redisAddr, timeLimit, cacheSize, portStr, portType := getEnvironmentVariables()
@@ -229,19 +771,78 @@ func main() {
 
 	redisCache = createLockableCache(cacheSize)
 
+	idleTimeout = time.Duration(getIdleTimeout()) * time.Millisecond
+
+	setForwardingLists(getForwardingVariables())
+	updateOnWrite = getUpdateOnWrite()
+	upstreamProtocol = getUpstreamProtocol()
+	upstreamRetries = getUpstreamRetries()
+
 	startExpiryDaemon(timeLimit, 100)
 	defer stopExpiryDaemon()
 
 	var err error
-	redisClient, err = createRedisClient(redisAddr)
+	// The pool reconnects as needed, so the upstream may start later
+	if sentinels, masterName, flush := getSentinelVariables(); len(sentinels) > 0 {
+		log.Printf("Following master '%s' through sentinels: %s\n", masterName, strings.Join(sentinels, ","))
+		flushOnSwitch = flush
+		var p *sentinelPool
+		p, err = createSentinelPool(sentinels, masterName, getPoolSize())
+		redisPool, redisAddr = p, p.masterAddr()
+	} else if getClusterMode() {
+		log.Printf("Caching Redis Cluster, starting from node: %s\n", redisAddr)
+		startCluster(redisAddr, getPoolSize())
+		defer stopCluster()
+	} else if shardAddrs, weights := getShards(); len(shardAddrs) > 0 {
+		log.Printf("Sharding across: %s\n", strings.Join(shardAddrs, ","))
+		startShards(shardAddrs, weights, getShardVirtualNodes(), getPoolSize())
+		defer stopShards()
+	} else {
+		redisPool, err = createRedisPool(redisAddr, getPoolSize())
+	}
 	if err != nil {
-		log.Fatal("Error on 'redis' connection to '", redisAddr, "' error: ", err)
+		log.Print("Error on 'redis' connection to '", redisAddr, "' error: ", err)
+		noteUpstream(false)
+	}
+	if redisPool != nil {
+		defer redisPool.Empty()
+	}
+
+	if replicaAddrs := getReplicas(); len(replicaAddrs) > 0 {
+		log.Printf("Reading from replicas: %s\n", strings.Join(replicaAddrs, ","))
+		startReplicas(replicaAddrs, getPoolSize())
+		defer stopReplicas()
+	}
+
+	if peers, peersDNS, self := getPeerVariables(); len(peers) > 0 || peersDNS != "" {
+		startPeers(peers, peersDNS, self, portStr, getPoolSize())
+		defer stopPeers()
+	}
+
+	keyspaceNotifications := getKeyspaceNotifications()
+	clientTracking, trackingPrefixes := getTrackingVariables()
+	if _, clustered := currentCluster(); (clustered || shardRing != nil) && (keyspaceNotifications || clientTracking) {
+		// Each node would have to be listened to (and followed as slots move)
+		log.Println("Invalidations are not followed from Redis Cluster (or shards), cached values will expire instead")
+		keyspaceNotifications, clientTracking = false, false
+	}
+	if keyspaceNotifications {
+		startNotificationListener(redisAddr)
+		defer stopNotificationListener()
+	}
+	if clientTracking {
+		startTrackingListener(redisAddr, trackingPrefixes)
+		defer stopTrackingListener()
+	}
+
+	if slots, announce := getClusterSlots(); len(slots) > 0 {
+		log.Printf("Presenting as a Redis Cluster, as node: %s\n", announce)
+		servedSlots, announceAddr = slots, announce
 	}
-	defer redisClient.Close()
 
 	if portType == "http" {
 		router := createRouter()
-		log.Printf("Caching HTTP redis proxy now listening on port " + portStr + "...\n")
+		log.Printf("Caching HTTP redis proxy now listening on port %s...\n", portStr)
 		log.Fatal(http.ListenAndServe(":"+portStr, router))
 	} else {
 		// TCP listener
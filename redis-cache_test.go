@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -8,24 +10,40 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mediocregopher/radix.v2/redis"
 )
 
 var router *mux.Router
 
+var testRedisAddr string
+
+// TCP connections are kept open until the client sends QUIT
+const quitRequest = "*1\r\n$4\r\nQUIT\r\n"
+
 func TestMain(m *testing.M) {
 
+	// Run as a stand-alone caching tier (see startTier)
+	if os.Getenv("REDIS_CACHE_TEST_TIER") != "" {
+		main()
+		return
+	}
+
 	// We will only use 'redisAddr', the rest are included for code coverage purposes.
 	redisAddr, timeLimit, cacheSize, portStr, portType := getEnvironmentVariables()
 	log.Printf("Caching redis: %s, expiry=%d, cache size=%d, port=%s, type=%s\n", redisAddr, timeLimit, cacheSize, portStr, portType)
 	go startListener("5000")
+	testRedisAddr = redisAddr
 
-	redisClient, _ = createRedisClient(redisAddr)
-	defer redisClient.Close()
+	redisPool, _ = createRedisPool(redisAddr, 10)
+	defer redisPool.Empty()
 
 	// Set up some data in Redis backend
 	setUpTestData()
@@ -76,7 +94,7 @@ func TestCacheMissTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err := fmt.Fprintf(clientConn, wrapRedisKey("key50"))
+	_, err := fmt.Fprint(clientConn, wrapRedisKey("key50")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -112,7 +130,7 @@ func TestGetExistingRedisKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err := fmt.Fprintf(clientConn, wrapRedisKey("key1"))
+	_, err := fmt.Fprint(clientConn, wrapRedisKey("key1")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -148,7 +166,7 @@ func TestGetNonexistentRedisKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err := fmt.Fprintf(clientConn, wrapRedisKey("doesNotExist"))
+	_, err := fmt.Fprint(clientConn, wrapRedisKey("doesNotExist")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -158,8 +176,9 @@ func TestGetNonexistentRedisKeyTCP(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if message := string(unwrapRedisValue(buf[:])); message != "" {
-		t.Errorf("Expected ''. Got '%s'", message)
+	// Expect a nil reply (not an empty string)
+	if message := string(buf); message != "$-1\r\n+OK\r\n" {
+		t.Errorf("Expected '$-1\\r\\n+OK\\r\\n'. Got %q", message)
 	}
 
 	if cacheHit != 0 {
@@ -178,6 +197,280 @@ func TestGetNonexistentRedisKeyTCP(t *testing.T) {
 	clearCacheStats()
 }
 
+func TestGetBinaryRedisKeyTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	key := "binary\r\nkey\x00"
+	val := "binary\r\nvalue"
+	err := redisPool.Cmd("SET", key, val).Err
+	if err != nil {
+		log.Println("Error on TestGetBinaryRedisKeyTCP SET '", key, "' to '", val, "': ", err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	// Pipe is in-memory but good practice to close
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go handleRequest(serverConn)
+
+	// Send the request split across several writes
+	request := wrapRedisKey(key) + quitRequest
+	for _, segment := range []string{request[:3], request[3:17], request[17:]} {
+		_, err = fmt.Fprint(clientConn, segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message := string(unwrapRedisValue(buf[:])); message != val {
+		t.Errorf("Expected %q. Got %q", val, message)
+	}
+
+	if cacheMiss != 1 {
+		t.Errorf("Expected cacheMiss '1'. Got '%d'", cacheMiss)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestMultipleCommandsPerConnectionTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	// Connect to the listener started in TestMain, as a client library would
+	client, err := redis.Dial("tcp", "localhost:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, key := range []string{"key1", "key2", "key1"} {
+		val, err := client.Cmd("GET", key).Str()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "value" + key[3:]; val != expected {
+			t.Errorf("Expected '%s'. Got '%s'", expected, val)
+		}
+	}
+
+	if cacheHit != 1 {
+		t.Errorf("Expected cacheHit '1'. Got '%d'", cacheHit)
+	}
+	if cacheMiss != 2 {
+		t.Errorf("Expected cacheMiss '2'. Got '%d'", cacheMiss)
+	}
+
+	res, err := client.Cmd("QUIT").Str()
+	if err != nil || res != "OK" {
+		t.Errorf("Expected 'OK'. Got '%s' (%v)", res, err)
+	}
+
+	// Connection is now closed
+	if resp := client.Cmd("GET", "key1"); !resp.IsType(redis.IOErr) {
+		t.Errorf("Expected IO error after QUIT. Got '%v'", resp)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestPipelinedGetsTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	// Cache 'key1' ahead of time
+	getRedisValue("key1")
+	clearCacheStats()
+
+	clientConn, serverConn := net.Pipe()
+	// Pipe is in-memory but good practice to close
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go handleRequest(serverConn)
+
+	// Send all of the requests before reading any replies
+	keys := []string{"key1", "key2", "key3", "key1"}
+	pipeline := ""
+	for _, key := range keys {
+		pipeline += wrapRedisKey(key)
+	}
+	_, err := fmt.Fprint(clientConn, pipeline+quitRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(buf))
+	for _, key := range keys {
+		reply, err := readRESP(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "value" + key[3:]; string(reply.str) != expected {
+			t.Errorf("Expected '%s'. Got '%s'", expected, reply.str)
+		}
+	}
+	if reply, err := readRESP(reader); err != nil || string(reply.str) != "OK" {
+		t.Errorf("Expected 'OK'. Got '%s' (%v)", reply.str, err)
+	}
+
+	if cacheHit != 2 {
+		t.Errorf("Expected cacheHit '2'. Got '%d'", cacheHit)
+	}
+	if cacheMiss != 2 {
+		t.Errorf("Expected cacheMiss '2'. Got '%d'", cacheMiss)
+	}
+	// Both misses should be fetched together
+	if upstreamFetch != 1 {
+		t.Errorf("Expected upstreamFetch '1'. Got '%d'", upstreamFetch)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestPipelinedClientTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	client, err := redis.Dial("tcp", "localhost:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 1; i <= 100; i++ {
+		client.PipeAppend("GET", "key"+strconv.Itoa(i))
+	}
+	for i := 1; i <= 100; i++ {
+		val, err := client.PipeResp().Str()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "value" + strconv.Itoa(i); val != expected {
+			t.Errorf("Expected '%s'. Got '%s'", expected, val)
+		}
+	}
+
+	if cacheMiss != 100 {
+		t.Errorf("Expected cacheMiss '100'. Got '%d'", cacheMiss)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestIdleTimeoutTCP(t *testing.T) {
+
+	// Connections from earlier tests must not see the change
+	waitForDisconnects()
+	idleTimeout = 100 * time.Millisecond
+	defer func() { idleTimeout = 0 }()
+
+	clientConn, serverConn := net.Pipe()
+	// Pipe is in-memory but good practice to close
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	done := make(chan bool)
+	go func() {
+		handleRequest(serverConn)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected idle connection to be closed")
+	}
+
+	buf, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 0 {
+		t.Errorf("Expected no reply. Got %q", buf)
+	}
+}
+
+func TestGetNonexistentRedisKeyTiers(t *testing.T) {
+
+	// Stack this process's tiers on top of a separate TCP tier
+	stopTier := startTier(t, testRedisAddr, "7001", "tcp")
+	defer stopTier()
+
+	tierPool, err := createRedisPool("localhost:7001", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tierPool.Empty()
+
+	backendPool := redisPool
+	redisPool = tierPool
+	defer func() { redisPool = backendPool }()
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	// HTTP tier -> TCP tier -> redis
+	req, err := http.NewRequest("GET", "/doesNotExist", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest: %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// TCP tier -> TCP tier -> redis
+	clientConn, serverConn := net.Pipe()
+	// Pipe is in-memory but good practice to close
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go handleRequest(serverConn)
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("doesNotExist")+quitRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message := string(buf); message != "$-1\r\n+OK\r\n" {
+		t.Errorf("Expected '$-1\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+
+	// The miss must not be cached as an empty string
+	cacheSize := redisCache.lru.Len()
+	if cacheSize != 0 {
+		t.Errorf("Expected cache size '0'. Got '%d'", cacheSize)
+	}
+	if cacheMiss != 2 {
+		t.Errorf("Expected cacheMiss '2'. Got '%d'", cacheMiss)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
 func TestGetExpiredCacheKeyTCP(t *testing.T) {
 
 	clearCacheStats()
@@ -187,7 +480,7 @@ func TestGetExpiredCacheKeyTCP(t *testing.T) {
 
 	key := "expiringCacheKey"
 	val := "no expiry"
-	err := redisClient.Cmd("SET", key, val).Err
+	err := redisPool.Cmd("SET", key, val).Err
 	if err != nil {
 		log.Println("Error on TestGetExpiredCacheKey SET '", key, "' to '", val, "': ", err)
 	}
@@ -198,7 +491,7 @@ func TestGetExpiredCacheKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("expiringCacheKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("expiringCacheKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -225,7 +518,7 @@ func TestGetExpiredCacheKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("expiringCacheKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("expiringCacheKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -261,7 +554,7 @@ func TestGetExpiredRedisKeyTCP(t *testing.T) {
 
 	key := "expiringRedisKey"
 	val := "6 seconds"
-	err := redisClient.Cmd("SET", key, val, "EX", 6).Err
+	err := redisPool.Cmd("SET", key, val, "EX", 6).Err
 	if err != nil {
 		log.Println("Error on TestGetExpiredRedisKey SET '", key, "' to '", val, "': ", err)
 	}
@@ -272,7 +565,7 @@ func TestGetExpiredRedisKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("expiringRedisKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("expiringRedisKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -302,7 +595,7 @@ func TestGetExpiredRedisKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("expiringRedisKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("expiringRedisKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -338,7 +631,7 @@ func TestGetTouchedCacheKeyTCP(t *testing.T) {
 
 	key := "touchedCacheKey"
 	val := "no expiry"
-	err := redisClient.Cmd("SET", key, val).Err
+	err := redisPool.Cmd("SET", key, val).Err
 	if err != nil {
 		log.Println("Error on TestGetTouchedCacheKeyTCP SET '", key, "' to '", val, "': ", err)
 	}
@@ -349,7 +642,7 @@ func TestGetTouchedCacheKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("touchedCacheKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("touchedCacheKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -374,7 +667,7 @@ func TestGetTouchedCacheKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("touchedCacheKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("touchedCacheKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -397,7 +690,7 @@ func TestGetTouchedCacheKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("touchedCacheKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("touchedCacheKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -422,7 +715,7 @@ func TestGetTouchedCacheKeyTCP(t *testing.T) {
 	defer serverConn.Close()
 
 	go handleRequest(serverConn)
-	_, err = fmt.Fprintf(clientConn, wrapRedisKey("touchedCacheKey"))
+	_, err = fmt.Fprint(clientConn, wrapRedisKey("touchedCacheKey")+quitRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -495,6 +788,139 @@ func TestCacheHit(t *testing.T) {
 	clearCacheStats()
 }
 
+func TestMultiGet(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	// Cache 'key2' ahead of time
+	getRedisValue("key2")
+	clearCacheStats()
+
+	req, err := http.NewRequest("GET", "/?key=key1&key=key2&key=doesNotExist&key=key3", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest: %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if body := response.Body.String(); body != `["value1","value2",null,"value3"]`+"\n" {
+		t.Errorf(`Expected '["value1","value2",null,"value3"]'. Got '%s'`, body)
+	}
+
+	if cacheHit != 1 {
+		t.Errorf("Expected cacheHit '1'. Got '%d'", cacheHit)
+	}
+	if cacheMiss != 3 {
+		t.Errorf("Expected cacheMiss '3'. Got '%d'", cacheMiss)
+	}
+	// All of the misses should be fetched with one MGET
+	if upstreamFetch != 1 {
+		t.Errorf("Expected upstreamFetch '1'. Got '%d'", upstreamFetch)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+// Run with 'go test -race' to check that concurrent misses share the
+// upstream pool (and the cache) safely.
+func TestConcurrentMissesTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	errs := make(chan error, 50)
+	for c := 0; c < 50; c++ {
+		go func(c int) {
+			client, err := redis.Dial("tcp", "localhost:5000")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+
+			for i := 0; i < 20; i++ {
+				n := strconv.Itoa((c*20+i)%100 + 1)
+				client.PipeAppend("GET", "key"+n)
+				client.PipeAppend("MGET", "key"+n, "doesNotExist")
+			}
+			for i := 0; i < 20; i++ {
+				n := strconv.Itoa((c*20+i)%100 + 1)
+				val, err := client.PipeResp().Str()
+				if err == nil && val != "value"+n {
+					err = fmt.Errorf("Expected 'value%s'. Got '%s'", n, val)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				vals, err := client.PipeResp().List()
+				if err == nil && (len(vals) != 2 || vals[0] != "value"+n) {
+					err = fmt.Errorf("Expected '[value%s ]'. Got '%v'", n, vals)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(c)
+
+		// Keep some of the reads missing
+		if c%10 == 0 {
+			redisCache.lru.Purge()
+		}
+	}
+	for c := 0; c < 50; c++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if total := cacheHit + cacheMiss; total != 50*20*3 {
+		t.Errorf("Expected %d lookups. Got '%d'", 50*20*3, total)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestConcurrentMisses(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	errs := make(chan error, 50)
+	for c := 0; c < 50; c++ {
+		go func(c int) {
+			for i := 0; i < 20; i++ {
+				n := strconv.Itoa((c*20+i)%100 + 1)
+				req, err := http.NewRequest("GET", "/key"+n, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				response := executeRequest(req)
+				if body := response.Body.String(); body != "value"+n {
+					errs <- fmt.Errorf("Expected 'value%s'. Got '%s'", n, body)
+					return
+				}
+			}
+			errs <- nil
+		}(c)
+
+		if c%10 == 0 {
+			redisCache.lru.Purge()
+		}
+	}
+	for c := 0; c < 50; c++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
 func loadCache(t *testing.T) {
 
 	for i := 1; i <= 100; i++ {
@@ -616,7 +1042,7 @@ func TestGetExpiredCacheKey(t *testing.T) {
 
 	key := "expiringCacheKey"
 	val := "no expiry"
-	err := redisClient.Cmd("SET", key, val).Err
+	err := redisPool.Cmd("SET", key, val).Err
 	if err != nil {
 		log.Println("Error on TestGetExpiredCacheKey SET '", key, "' to '", val, "': ", err)
 	}
@@ -672,7 +1098,7 @@ func TestGetExpiredRedisKey(t *testing.T) {
 
 	key := "expiringRedisKey"
 	val := "6 seconds"
-	err := redisClient.Cmd("SET", key, val, "EX", 6).Err
+	err := redisPool.Cmd("SET", key, val, "EX", 6).Err
 	if err != nil {
 		log.Println("Error on TestGetExpiredRedisKey SET '", key, "' to '", val, "': ", err)
 	}
@@ -731,7 +1157,7 @@ func TestGetTouchedCacheKey(t *testing.T) {
 
 	key := "touchedCacheKey"
 	val := "no expiry"
-	err := redisClient.Cmd("SET", key, val).Err
+	err := redisPool.Cmd("SET", key, val).Err
 	if err != nil {
 		log.Println("Error on TestGetTouchedCacheKey SET '", key, "' to '", val, "': ", err)
 	}
@@ -807,7 +1233,7 @@ func setUpTestData() {
 
 	log.Printf("Running setUpTestData")
 
-	err := redisClient.Cmd("FLUSHDB").Err
+	err := redisPool.Cmd("FLUSHDB").Err
 	if err != nil {
 		log.Println("Error on setUpTestData FLUSHDB: ", err)
 	}
@@ -816,7 +1242,7 @@ func setUpTestData() {
 		iStr := strconv.Itoa(i)
 		key := "key" + iStr
 		value := "value" + iStr
-		err = redisClient.Cmd("SET", key, value).Err
+		err = redisPool.Cmd("SET", key, value).Err
 		if err != nil {
 			log.Println("Error on setUpTestData SET ", key, " TO ", value, ": ", err)
 		}
@@ -827,12 +1253,85 @@ func tearDownTestData() {
 
 	log.Printf("Running tearDownTestData")
 
-	err := redisClient.Cmd("FLUSHDB").Err
+	err := redisPool.Cmd("FLUSHDB").Err
 	if err != nil {
 		log.Println("Error on tearDownTestData FLUSHDB: ", err)
 	}
 }
 
+// startTier runs this test binary as a separate caching tier (see
+// TestMain) in front of 'upstream', with any further environment
+// variables, returning a function to stop it.
+func startTier(t *testing.T, upstream string, portStr string, portType string, env ...string) func() {
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = []string{
+		"REDIS_CACHE_TEST_TIER=1",
+		"REDIS=" + upstream,
+		"EXPIRY_TIME=5000",
+		"CACHE_SIZE=50",
+		"PORT=" + portStr,
+		"TYPE=" + portType,
+	}
+	cmd.Env = append(cmd.Env, env...)
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the tier to start listening
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", "localhost:"+portStr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+// waitForDisconnects waits (for up to a second) until every TCP client
+// connection to this process, such as those to port 5000, has closed.
+func waitForDisconnects() {
+
+	for i := 0; i < 100; i++ {
+		downstreamLock.Lock()
+		connected := len(clients)
+		downstreamLock.Unlock()
+		if connected == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendTCP writes the request(s) to a new TCP handler connection and
+// returns everything written back before the connection is closed.
+func sendTCP(t *testing.T, request string) []byte {
+
+	clientConn, serverConn := net.Pipe()
+	// Pipe is in-memory but good practice to close
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go handleRequest(serverConn)
+	_, err := fmt.Fprint(clientConn, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 
 	//log.Printf("Running executeRequest")
@@ -850,3 +1349,128 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 		t.Errorf("Expected response code %d. Got %d\n", expected, actual)
 	}
 }
+
+// standIn is a minimal stand-in Redis server, for upstream behaviour which
+// the backing Redis can't be made to show. It answers each command with
+// the replies from 'handler' and can push further replies to its clients.
+type standIn struct {
+	nlr      net.Listener
+	handler  func(args [][]byte) []respValue
+	commands chan string // the name of each command received
+	conns    []net.Conn
+	lock     sync.Mutex
+}
+
+func startStandIn(t *testing.T, handler func(args [][]byte) []respValue) *standIn {
+
+	return startStandInAt(t, "localhost:0", handler)
+}
+
+// startStandInAt starts a stand-in listening on the address (say, that of one restarting).
+func startStandInAt(t *testing.T, addr string, handler func(args [][]byte) []respValue) *standIn {
+
+	nlr, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standIn{nlr: nlr, handler: handler, commands: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := nlr.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standIn) serve(conn net.Conn) {
+
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		args, err := commandArgs(req)
+		if err != nil {
+			return
+		}
+		var buf []byte
+		for _, reply := range s.handler(args) {
+			buf = appendRESP(buf, reply)
+		}
+		s.lock.Lock()
+		conn.Write(buf)
+		s.lock.Unlock()
+
+		select {
+		case s.commands <- strings.ToUpper(string(args[0])):
+		default:
+		}
+	}
+}
+
+func (s *standIn) addr() string {
+	return s.nlr.Addr().String()
+}
+
+// waitFor waits (for up to 5 seconds) until the stand-in receives the command.
+func (s *standIn) waitFor(t *testing.T, command string) {
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case name := <-s.commands:
+			if name == command {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected the stand-in to receive '%s'", command)
+		}
+	}
+}
+
+// push writes the reply to every client connection.
+func (s *standIn) push(reply respValue) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Write(appendRESP(nil, reply))
+	}
+}
+
+// drop closes every client connection.
+func (s *standIn) drop() {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *standIn) close() {
+
+	s.nlr.Close()
+	s.drop()
+}
+
+// respCommand builds the RESP array for a command (or pushed message).
+func respCommand(args ...string) respValue {
+
+	elems := make([]respValue, len(args))
+	for i, arg := range args {
+		elems[i] = respBulk([]byte(arg))
+	}
+	return respArrayOf(elems...)
+}
@@ -0,0 +1,361 @@
+// resp-commands handles the Redis commands served by the TCP listener.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// errUpstreamUnavailable is returned when the upstream Redis cannot be reached.
+var errUpstreamUnavailable = errors.New("ERR upstream unavailable")
+
+// Read commands (other than GET and MGET) whose replies are cached, with
+// the number of arguments (including the command name) required; negative
+// means at least that many. Other uses are simply forwarded to Redis.
+var cachedCommands = map[string]int{
+	"EXISTS":        2,
+	"HGET":          3,
+	"HGETALL":       2,
+	"HMGET":         -3,
+	"LRANGE":        4,
+	"SISMEMBER":     3,
+	"SMEMBERS":      2,
+	"STRLEN":        2,
+	"ZRANGE":        -4,
+	"ZRANGEBYSCORE": -4,
+}
+
+// Redis truncates client-supplied arguments quoted in error replies
+const maxErrorArgLength = 128
+
+// respUnavailable stands in for the reply of an upstream which couldn't
+// be reached (the error being why), and is relayed as errUpstreamUnavailable.
+func respUnavailable(err error) respValue {
+
+	return respValue{kind: respError, str: []byte(errUpstreamUnavailable.Error()), err: err}
+}
+
+// upstreamError maps a failed upstream reply to the error to report to
+// clients; Redis errors (such as WRONGTYPE) are passed on unchanged.
+func upstreamError(reply respValue) error {
+
+	if reply.isError() && reply.err == nil {
+		return errors.New(string(reply.str))
+	}
+	return errUpstreamUnavailable
+}
+
+// serveCommands answers a batch of pipelined commands in order. Cache
+// misses and forwarded commands are sent upstream in a single round trip.
+// It returns true if the connection should then be closed.
+func serveCommands(c *clientConn, reqs []respValue) (quit bool) {
+
+	replies := make([]respValue, 0, len(reqs))
+
+	// Completes the replies which are waiting on the upstream pipeline
+	var pending []func(reply respValue)
+	var p upstreamPipeline
+
+	// Completes the replies which are waiting on another's cache miss
+	var waiting []func()
+
+	// Keys changed by writes waiting on the upstream pipeline
+	written := make(map[string]bool)
+	writtenAll := false
+
+	run := func() {
+		// Misses for peers are only sent upstream
+		p.fromPeer = c.name == peerClientName
+		resps := p.run()
+		for i, complete := range pending {
+			complete(resps[i])
+		}
+		p.finish()
+		for _, complete := range waiting {
+			complete()
+		}
+		p, pending, waiting = upstreamPipeline{}, nil, nil
+		written, writtenAll = make(map[string]bool), false
+	}
+
+	// Reads of a key written earlier in the pipeline must wait for
+	// the write to complete (and invalidate the cached reply).
+	flush := func(keys ...string) {
+		stale := writtenAll
+		for _, key := range keys {
+			stale = stale || written[key]
+		}
+		if stale {
+			run()
+		}
+	}
+
+	for _, req := range reqs {
+		args, err := commandArgs(req)
+		if err != nil {
+			// As with Redis, protocol errors close the connection
+			log.Printf("Got bad request: %q\n", appendRESP(nil, req))
+			replies = append(replies, respErr("ERR Protocol error"))
+			quit = true
+			break
+		}
+
+		reply := len(replies)
+		replies = append(replies, respValue{})
+
+		name := strings.ToUpper(string(args[0]))
+		// Only RESP3 clients can send other commands while subscribed
+		if c.subscribed && c.proto == 2 && !subscribedCommand(name) {
+			replies[reply] = respErr(fmt.Sprintf("ERR Can't execute '%s': only SUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(errorArg(args[0]))))
+			continue
+		}
+
+		// Presented as a cluster, keys served by other proxies are redirected
+		if servedSlots != nil {
+			switch name {
+			case "CLUSTER":
+				replies[reply] = serveClusterCommand(args)
+				continue
+			case "READONLY", "READWRITE":
+				replies[reply] = respSimple("OK")
+				continue
+			}
+			if moved, ok := movedReply(servedKeys(args)); ok {
+				replies[reply] = moved
+				continue
+			}
+		}
+
+		// Peers evict the keys written through each other
+		if name == peerInvalidate && c.name == peerClientName {
+			replies[reply] = invalidateFromPeer(args)
+			continue
+		}
+
+		switch name {
+		case "QUIT":
+			replies[reply] = respSimple("OK")
+			quit = true
+		case "HELLO":
+			replies[reply] = hello(c, args)
+		case "CLIENT":
+			replies[reply] = serveClientCommand(c, args)
+		case "SUBSCRIBE":
+			replies[reply] = subscribe(c, args)
+		case "GET":
+			if len(args) != 2 {
+				replies[reply] = wrongArity(args)
+				continue
+			}
+			key := string(args[1])
+			c.track(key)
+			flush(key)
+			val, found := getCachedValue(key)
+			if found {
+				atomic.AddInt64(&cacheHit, 1)
+				replies[reply] = respBulk([]byte(val))
+				continue
+			}
+			atomic.AddInt64(&cacheMiss, 1)
+			f, lead := joinFlight(getCacheKey(key))
+			if !lead {
+				waiting = append(waiting, func() {
+					replies[reply] = valueReply(redisValue(key, f.wait()))
+				})
+				continue
+			}
+			p.add("GET", key)
+			p.lead(f, getCacheKey(key), -1)
+			pending = append(pending, func(resp respValue) {
+				replies[reply] = valueReply(cacheRedisValue(key, resp, p.deadline(key)))
+			})
+		case "MGET":
+			if len(args) < 2 {
+				replies[reply] = wrongArity(args)
+				continue
+			}
+			keys := make([]string, len(args)-1)
+			for i, arg := range args[1:] {
+				keys[i] = string(arg)
+			}
+			c.track(keys...)
+			flush(keys...)
+			vals, misses := getCachedValues(keys)
+			errs := make([]error, len(keys))
+			if len(misses) == 0 {
+				replies[reply] = multiValueReply(vals, errs)
+				continue
+			}
+			fetches, joined, led := joinFlights(keys, misses)
+			if len(fetches) > 0 {
+				p.add("MGET", mgetArgs(keys, fetches)...)
+				for j, i := range fetches {
+					p.lead(led[j], getCacheKey(keys[i]), j)
+				}
+				pending = append(pending, func(resp respValue) {
+					cacheRedisMultiValues(keys, fetches, resp, p.deadline, vals, errs)
+				})
+			}
+			waiting = append(waiting, func() {
+				for i, f := range joined {
+					vals[i], errs[i] = redisValue(keys[i], f.wait())
+				}
+				replies[reply] = multiValueReply(vals, errs)
+			})
+		case "PTTL", "TTL":
+			if len(args) != 2 {
+				replies[reply] = wrongArity(args)
+				continue
+			}
+			key := string(args[1])
+			c.track(key)
+			flush(key)
+			if ttl, found := cachedTTL(key); found {
+				replies[reply] = ttlReply(name, ttl)
+				continue
+			}
+			if errReply, ok := checkForwardable(args); !ok {
+				replies[reply] = errReply
+				continue
+			}
+			p.add(string(args[0]), key)
+			pending = append(pending, func(resp respValue) {
+				replies[reply] = resp
+			})
+		default:
+			if isCachedCommand(args) {
+				ck := commandCacheKey(args)
+				c.track(ck.key)
+				flush(ck.key)
+				val, found := getCachedReply(ck)
+				if found {
+					atomic.AddInt64(&cacheHit, 1)
+					replies[reply] = val
+					continue
+				}
+				atomic.AddInt64(&cacheMiss, 1)
+				f, lead := joinFlight(ck)
+				if !lead {
+					waiting = append(waiting, func() {
+						replies[reply] = f.wait()
+					})
+					continue
+				}
+				p.add(string(args[0]), forwardArgs(args)...)
+				p.lead(f, ck, -1)
+				pending = append(pending, func(resp respValue) {
+					replies[reply] = cacheRedisReply(ck, resp, p.deadline(ck.key))
+				})
+				continue
+			}
+			if errReply, ok := checkForwardable(args); !ok {
+				replies[reply] = errReply
+				continue
+			}
+			keys, all := writtenKeys(args)
+			for _, key := range keys {
+				written[key] = true
+			}
+			writtenAll = writtenAll || all
+			if len(keys) == 0 && !all {
+				c.track(readKeys(args)...)
+			}
+			p.forward(string(args[0]), forwardArgs(args)...)
+			pending = append(pending, func(resp respValue) {
+				replies[reply] = resp
+				invalidateWrite(&p, args, replies[reply])
+			})
+		}
+		if quit {
+			break
+		}
+	}
+
+	run()
+
+	if err := c.send(replies...); err != nil {
+		log.Println("Error writing:", err.Error())
+		return true
+	}
+	return quit
+}
+
+func isCachedCommand(args [][]byte) bool {
+
+	arity, ok := cachedCommands[strings.ToUpper(string(args[0]))]
+	if !ok {
+		return false
+	}
+	if arity < 0 {
+		return len(args) >= -arity
+	}
+	return len(args) == arity
+}
+
+// commandCacheKey returns the cache key for a cached read command,
+// whose first argument is always the Redis key.
+func commandCacheKey(args [][]byte) cacheKey {
+
+	ck := cacheKey{key: string(args[1]), cmd: strings.ToUpper(string(args[0]))}
+	if len(args) > 2 {
+		// Arguments are RESP-encoded so that they cannot be confused
+		var encoded []byte
+		for _, arg := range args[2:] {
+			encoded = appendRESP(encoded, respBulk(arg))
+		}
+		ck.args = string(encoded)
+	}
+	return ck
+}
+
+// valueReply encodes the result of a cache lookup.
+func valueReply(val string, err error) respValue {
+
+	if err == redis.ErrRespNil {
+		// Missing key
+		return respNil()
+	}
+	if err != nil {
+		return respErr(err.Error())
+	}
+	return respBulk([]byte(val))
+}
+
+// multiValueReply encodes the results of an MGET; any upstream
+// error fails the whole command.
+func multiValueReply(vals []string, errs []error) respValue {
+
+	elems := make([]respValue, len(vals))
+	for i, val := range vals {
+		if errs[i] != nil && errs[i] != redis.ErrRespNil {
+			return respErr(errs[i].Error())
+		}
+		elems[i] = valueReply(val, errs[i])
+	}
+	return respArrayOf(elems...)
+}
+
+func wrongArity(args [][]byte) respValue {
+
+	return respErr(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(errorArg(args[0]))))
+}
+
+// errorArg makes a client-supplied argument safe to quote in a
+// simple string error reply (which cannot contain CR or LF).
+func errorArg(arg []byte) string {
+
+	if len(arg) > maxErrorArgLength {
+		arg = arg[:maxErrorArgLength]
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, string(arg))
+}
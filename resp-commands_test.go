@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWrongArity(t *testing.T) {
+
+	var buf bytes.Buffer
+	reqs := []respValue{
+		respArrayOf(respBulk([]byte("get"))),
+		respArrayOf(respBulk([]byte("GET")), respBulk([]byte("k1")), respBulk([]byte("k2"))),
+	}
+
+	quit := serveCommands(newClientConn(&buf), reqs)
+	if quit {
+		t.Errorf("Expected connection to stay open")
+	}
+
+	expected := "-ERR wrong number of arguments for 'get' command\r\n" +
+		"-ERR wrong number of arguments for 'get' command\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q. Got %q", expected, buf.String())
+	}
+}
+
+func TestProtocolErrorTCP(t *testing.T) {
+
+	// A command must be an array of bulk strings
+	buf := sendTCP(t, wrapRedisKey("key1")+"*1\r\n:1\r\n"+wrapRedisKey("key2"))
+
+	if message := string(buf); message != "$6\r\nvalue1\r\n-ERR Protocol error\r\n" {
+		t.Errorf("Expected '$6\\r\\nvalue1\\r\\n-ERR Protocol error\\r\\n'. Got %q", message)
+	}
+
+	buf = sendTCP(t, "*x\r\n")
+
+	if message := string(buf); message != "-ERR Protocol error\r\n" {
+		t.Errorf("Expected '-ERR Protocol error\\r\\n'. Got %q", message)
+	}
+	redisCache.lru.Purge()
+}
+
+func TestUpstreamUnavailable(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	// Stand-in upstream which drops every connection
+	nlr, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nlr.Close()
+	go func() {
+		for {
+			conn, err := nlr.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	deadPool, err := createRedisPool(nlr.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadPool.Empty()
+
+	backendPool := redisPool
+	redisPool = deadPool
+	defer func() { redisPool = backendPool }()
+
+	buf := sendTCP(t, wrapRedisKey("key1")+quitRequest)
+
+	if message := string(buf); message != "-ERR upstream unavailable\r\n+OK\r\n" {
+		t.Errorf("Expected '-ERR upstream unavailable\\r\\n+OK\\r\\n'. Got %q", message)
+	}
+
+	req, err := http.NewRequest("GET", "/key1", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest: %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+
+	cacheSize := redisCache.lru.Len()
+	if cacheSize != 0 {
+		t.Errorf("Expected cache size '0'. Got '%d'", cacheSize)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestUpstreamWrongType(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	err := redisPool.Cmd("RPUSH", "listKey", "value").Err
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redisPool.Cmd("DEL", "listKey")
+
+	// Redis errors are passed on unchanged
+	buf := sendTCP(t, wrapRedisKey("listKey")+quitRequest)
+
+	if message := string(buf); !strings.HasPrefix(message, "-WRONGTYPE ") {
+		t.Errorf("Expected WRONGTYPE error. Got %q", message)
+	}
+
+	req, err := http.NewRequest("GET", "/listKey", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest: %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadGateway, response.Code)
+
+	if body := response.Body.String(); !strings.HasPrefix(body, "WRONGTYPE ") {
+		t.Errorf("Expected WRONGTYPE error. Got '%s'", body)
+	}
+	redisCache.lru.Purge()
+}
+
+func TestMultiGetTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	// Cache 'key1' and 'key3' ahead of time
+	getRedisValues([]string{"key1", "key3"})
+	clearCacheStats()
+
+	mget := string(appendRESP(nil, respArrayOf(
+		respBulk([]byte("MGET")),
+		respBulk([]byte("key1")),
+		respBulk([]byte("key2")),
+		respBulk([]byte("doesNotExist")),
+		respBulk([]byte("key3")),
+	)))
+	buf := sendTCP(t, mget+mget+quitRequest)
+
+	reply := "*4\r\n$6\r\nvalue1\r\n$6\r\nvalue2\r\n$-1\r\n$6\r\nvalue3\r\n"
+	if message := string(buf); message != reply+reply+"+OK\r\n" {
+		t.Errorf("Expected %q. Got %q", reply+reply+"+OK\r\n", message)
+	}
+
+	// Both pipelined MGETs fetch their misses in the same round trip
+	if cacheHit != 4 {
+		t.Errorf("Expected cacheHit '4'. Got '%d'", cacheHit)
+	}
+	if cacheMiss != 4 {
+		t.Errorf("Expected cacheMiss '4'. Got '%d'", cacheMiss)
+	}
+	if upstreamFetch != 1 {
+		t.Errorf("Expected upstreamFetch '1'. Got '%d'", upstreamFetch)
+	}
+
+	buf = sendTCP(t, "*1\r\n$4\r\nMGET\r\n"+quitRequest)
+
+	if message := string(buf); message != "-ERR wrong number of arguments for 'mget' command\r\n+OK\r\n" {
+		t.Errorf("Expected wrong number of arguments. Got %q", message)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestCachedReadCommandsTCP(t *testing.T) {
+
+	clearCacheStats()
+	redisCache.lru.Purge()
+
+	redisPool.Cmd("HSET", "hashKey", "f1", "v1")
+	redisPool.Cmd("HSET", "hashKey", "f2", "v2")
+	redisPool.Cmd("RPUSH", "listKey", "a", "b", "c")
+	redisPool.Cmd("SADD", "setKey", "m1")
+	redisPool.Cmd("ZADD", "zsetKey", 1, "z1", 2, "z2")
+	defer redisPool.Cmd("DEL", "hashKey", "listKey", "setKey", "zsetKey")
+
+	cmds := [][]string{
+		{"HGET", "hashKey", "f1"},
+		{"HGET", "hashKey", "f2"},
+		{"HGET", "hashKey", "noField"},
+		{"HMGET", "hashKey", "f2", "noField"},
+		{"HGETALL", "hashKey"},
+		{"LRANGE", "listKey", "0", "-1"},
+		{"SMEMBERS", "setKey"},
+		{"SISMEMBER", "setKey", "m1"},
+		{"ZRANGE", "zsetKey", "0", "-1", "WITHSCORES"},
+		{"ZRANGEBYSCORE", "zsetKey", "2", "+inf"},
+		{"STRLEN", "key1"},
+		{"EXISTS", "key1"},
+	}
+
+	request := ""
+	expected := ""
+	for _, cmd := range cmds {
+		req := respArrayOf()
+		args := make([]interface{}, len(cmd)-1)
+		for i, arg := range cmd {
+			req.elems = append(req.elems, respBulk([]byte(arg)))
+			if i > 0 {
+				args[i-1] = arg
+			}
+		}
+		request += string(appendRESP(nil, req))
+		expected += string(appendRESP(nil, respFromRadix(redisPool.Cmd(cmd[0], args...))))
+	}
+
+	// Ask twice, the second time should be served from the cache
+	for i := 0; i < 2; i++ {
+		buf := sendTCP(t, request+quitRequest)
+
+		if message := string(buf); message != expected+"+OK\r\n" {
+			t.Errorf("Expected %q. Got %q", expected+"+OK\r\n", message)
+		}
+	}
+
+	// Nil replies (the missing hash field) are not cached
+	if cacheHit != int64(len(cmds)-1) {
+		t.Errorf("Expected cacheHit '%d'. Got '%d'", len(cmds)-1, cacheHit)
+	}
+	if cacheMiss != int64(len(cmds)+1) {
+		t.Errorf("Expected cacheMiss '%d'. Got '%d'", len(cmds)+1, cacheMiss)
+	}
+
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestRESP3RepliesTCP(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	redisPool.Cmd("HSET", "hashKey", "f1", "v1")
+	redisPool.Cmd("SADD", "setKey", "m1")
+	redisPool.Cmd("ZADD", "zsetKey", 1.5, "z1")
+	defer redisPool.Cmd("DEL", "hashKey", "setKey", "zsetKey")
+
+	// Replies from a RESP3 upstream are relayed (and cached) as sent
+	upstreamProtocol = 3
+	resp3Pool, err := createRedisPool(testRedisAddr, 2)
+	upstreamProtocol = 2
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp3Pool.Empty()
+	backendPool := redisPool
+	redisPool = resp3Pool
+	defer func() { redisPool = backendPool }()
+
+	c := dialTest(t)
+	defer c.conn.Close()
+	c.do(t, "HELLO", "3")
+
+	score := respValue{kind: respDouble, str: []byte("1.5")}
+	tests := []struct {
+		cmd      []string
+		expected respValue
+		resp2    respValue // as sent to RESP2 clients
+	}{
+		{[]string{"HGETALL", "hashKey"}, respMapOf(respBulk([]byte("f1")), respBulk([]byte("v1"))), respCommand("f1", "v1")},
+		{[]string{"SMEMBERS", "setKey"}, respValue{kind: respSet, elems: []respValue{respBulk([]byte("m1"))}}, respCommand("m1")},
+		{[]string{"ZSCORE", "zsetKey", "z1"}, score, respBulk([]byte("1.5"))},
+		{[]string{"ZSCORE", "zsetKey", "noMember"}, respValue{kind: respNull, null: true}, respNil()},
+		{[]string{"ZRANGE", "zsetKey", "0", "-1", "WITHSCORES"}, respArrayOf(respBulk([]byte("z1")), score), respCommand("z1", "1.5")},
+		{[]string{"GET", "key1"}, respBulk([]byte("value1")), respBulk([]byte("value1"))},
+	}
+	for _, test := range tests {
+		// Twice, for the cached reply too
+		for i := 0; i < 2; i++ {
+			if reply := c.do(t, test.cmd...); !reflect.DeepEqual(reply, test.expected) {
+				t.Errorf("%v expected %q. Got %q", test.cmd, appendRESP(nil, test.expected), appendRESP(nil, reply))
+			}
+		}
+	}
+
+	// And translated for RESP2 clients
+	c2 := dialTest(t)
+	defer c2.conn.Close()
+	for _, test := range tests {
+		if reply := c2.do(t, test.cmd...); !reflect.DeepEqual(reply, test.resp2) {
+			t.Errorf("%v expected %q. Got %q", test.cmd, appendRESP(nil, test.resp2), appendRESP(nil, reply))
+		}
+	}
+	redisCache.lru.Purge()
+}
+
+func TestInlineCommandsTCP(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	// As sent by 'echo ... | nc', mixed with RESP commands
+	buf := sendTCP(t, "GET key1\n\r\nget \"key2\"\r\n"+wrapRedisKey("key3")+"MGET key4 'doesNotExist'\nQUIT\n")
+
+	expected := "$6\r\nvalue1\r\n$6\r\nvalue2\r\n$6\r\nvalue3\r\n*2\r\n$6\r\nvalue4\r\n$-1\r\n+OK\r\n"
+	if message := string(buf); message != expected {
+		t.Errorf("Expected %q. Got %q", expected, message)
+	}
+
+	buf = sendTCP(t, "GET key1\nGET \"key2\n")
+
+	expected = "$6\r\nvalue1\r\n-ERR Protocol error: unbalanced quotes in request\r\n"
+	if message := string(buf); message != expected {
+		t.Errorf("Expected %q. Got %q", expected, message)
+	}
+	redisCache.lru.Purge()
+}
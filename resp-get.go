@@ -1,41 +1,578 @@
-// resp-get handles the RESP protocol wrapping & unwrapping for Redis GET requests.
+// resp-get handles the RESP protocol encoding & decoding for Redis requests and replies.
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"fmt"
+	"errors"
+	"io"
+	"strconv"
 )
 
+// RESP2 type prefixes
+const (
+	respSimpleString = '+'
+	respError        = '-'
+	respInteger      = ':'
+	respBulkString   = '$'
+	respArray        = '*'
+)
+
+// RESP3 type prefixes
+const (
+	respNull      = '_'
+	respDouble    = ','
+	respBoolean   = '#'
+	respBigNumber = '('
+	respBlobError = '!'
+	respVerbatim  = '='
+	respMap       = '%'
+	respSet       = '~'
+	respPush      = '>'
+	respAttribute = '|'
+)
+
+// Limits as per the Redis server defaults
+const (
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024
+)
+
+// Lengths are only trusted this far up front, so that a header claiming a
+// huge array or bulk string can't allocate memory its sender never fills
+const (
+	maxPreallocElems = 1024
+	bulkChunkLength  = 64 * 1024
+)
+
+// Upper bound on the number of pipelined commands answered together
+const maxPipeline = 1000
+
+// Limit on inline commands, as per Redis (which is also the
+// size of the buffer requests are read with)
+const maxInlineLength = 64 * 1024
+
+var errProtocol = errors.New("protocol error")
+var errUnbalancedQuotes = errors.New("unbalanced quotes in request")
+
+// respValue is a single decoded RESP value. Bulk strings are held
+// as raw bytes so that keys and values are binary-safe.
+// Doubles, booleans ('t' or 'f') and big numbers are held as their text,
+// and verbatim strings include their 3 character format and colon.
+type respValue struct {
+	kind  byte        // one of the RESP type prefixes
+	str   []byte      // string, error, double, boolean or big number payload
+	num   int64       // integer payload
+	elems []respValue // array, set or push elements, or map keys and values in turn
+	null  bool        // nil bulk string, nil array or null
+	attrs []respValue // any RESP3 attributes, keys and values in turn
+	err   error       // set (on an error reply) if the upstream couldn't be reached
+}
+
+func respSimple(s string) respValue {
+	return respValue{kind: respSimpleString, str: []byte(s)}
+}
+
+func respErr(msg string) respValue {
+	return respValue{kind: respError, str: []byte(msg)}
+}
+
+func respInt(n int64) respValue {
+	return respValue{kind: respInteger, num: n}
+}
+
+func respBulk(b []byte) respValue {
+	return respValue{kind: respBulkString, str: b}
+}
+
+func respNil() respValue {
+	return respValue{kind: respBulkString, null: true}
+}
+
+func respArrayOf(elems ...respValue) respValue {
+	return respValue{kind: respArray, elems: elems}
+}
+
+// respMapOf takes the map's keys and values in turn.
+func respMapOf(elems ...respValue) respValue {
+	return respValue{kind: respMap, elems: elems}
+}
+
+func respPushOf(elems ...respValue) respValue {
+	return respValue{kind: respPush, elems: elems}
+}
+
+func (v respValue) isError() bool {
+	return v.kind == respError || v.kind == respBlobError
+}
+
+// readRESP decodes the next RESP value from the reader, blocking until a
+// complete value has arrived (it may be spread over several TCP segments).
+func readRESP(r *bufio.Reader) (respValue, error) {
+
+	line, err := readRESPLine(r)
+	if err != nil {
+		return respValue{}, err
+	}
+	if len(line) == 0 {
+		return respValue{}, errProtocol
+	}
+
+	switch line[0] {
+	case respSimpleString, respError, respDouble, respBigNumber:
+		return respValue{kind: line[0], str: line[1:]}, nil
+	case respBoolean:
+		if len(line) != 2 || (line[1] != 't' && line[1] != 'f') {
+			return respValue{}, errProtocol
+		}
+		return respValue{kind: respBoolean, str: line[1:]}, nil
+	case respInteger:
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return respValue{}, errProtocol
+		}
+		return respInt(n), nil
+	case respBulkString, respBlobError, respVerbatim:
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < -1 || n > maxBulkLength {
+			return respValue{}, errProtocol
+		}
+		if n == -1 && line[0] == respBulkString {
+			return respNil(), nil
+		}
+		if n < 0 || (line[0] == respVerbatim && n < 4) {
+			return respValue{}, errProtocol
+		}
+		buf, err := readBulk(r, n)
+		if err != nil {
+			return respValue{}, err
+		}
+		return respValue{kind: line[0], str: buf}, nil
+	case respArray, respMap, respSet, respPush, respAttribute:
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < -1 || n > maxArrayLength {
+			return respValue{}, errProtocol
+		}
+		if n == -1 && line[0] == respArray {
+			return respValue{kind: respArray, null: true}, nil
+		}
+		if n == -1 {
+			return respValue{}, errProtocol
+		}
+		if line[0] == respMap || line[0] == respAttribute {
+			n *= 2
+		}
+		elems := make([]respValue, 0, min(n, maxPreallocElems))
+		for i := 0; i < n; i++ {
+			elem, err := readRESP(r)
+			if err != nil {
+				return respValue{}, err
+			}
+			elems = append(elems, elem)
+		}
+		if line[0] == respAttribute {
+			// Attributes precede the value they describe
+			v, err := readRESP(r)
+			if err != nil {
+				return respValue{}, err
+			}
+			v.attrs = elems
+			return v, nil
+		}
+		return respValue{kind: line[0], elems: elems}, nil
+	case respNull:
+		if len(line) != 1 {
+			return respValue{}, errProtocol
+		}
+		return respValue{kind: respNull, null: true}, nil
+	}
+	return respValue{}, errProtocol
+}
+
+// readRequest decodes the next command, which is either a RESP array or
+// (as typed into telnet or nc) an inline command. Empty lines are skipped.
+func readRequest(r *bufio.Reader) (respValue, error) {
+
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return respValue{}, err
+		}
+		if b[0] == respArray {
+			return readMultibulk(r)
+		}
+
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return respValue{}, errProtocol
+		}
+		if err != nil {
+			return respValue{}, err
+		}
+		args, err := splitInlineArgs(bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'}))
+		if err != nil {
+			return respValue{}, err
+		}
+		if len(args) > 0 {
+			return respArrayOf(args...), nil
+		}
+	}
+}
+
+// readMultibulk decodes a command sent as a RESP array which, as with
+// Redis, may only hold bulk strings (so a client can't nest arrays
+// deeply enough to exhaust the stack).
+func readMultibulk(r *bufio.Reader) (respValue, error) {
+
+	line, err := readRESPLine(r)
+	if err != nil {
+		return respValue{}, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < -1 || n > maxArrayLength {
+		return respValue{}, errProtocol
+	}
+	if n == -1 {
+		return respValue{kind: respArray, null: true}, nil
+	}
+
+	elems := make([]respValue, 0, min(n, maxPreallocElems))
+	for i := 0; i < n; i++ {
+		b, err := r.Peek(1)
+		if err != nil {
+			return respValue{}, err
+		}
+		if b[0] != respBulkString {
+			return respValue{}, errProtocol
+		}
+		elem, err := readRESP(r)
+		if err != nil {
+			return respValue{}, err
+		}
+		elems = append(elems, elem)
+	}
+	return respArrayOf(elems...), nil
+}
+
+// readBulk reads a bulk string's n bytes and trailing CRLF. The buffer
+// grows a chunk at a time as the data arrives, rather than by n up front.
+func readBulk(r *bufio.Reader, n int) ([]byte, error) {
+
+	buf := make([]byte, 0, min(n+2, bulkChunkLength))
+	for len(buf) < n+2 {
+		chunk := min(n+2-len(buf), bulkChunkLength)
+		if cap(buf)-len(buf) < chunk {
+			buf = append(buf, make([]byte, chunk)...)[:len(buf)]
+		}
+		if _, err := io.ReadFull(r, buf[len(buf):len(buf)+chunk]); err != nil {
+			return nil, err
+		}
+		buf = buf[:len(buf)+chunk]
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, errProtocol
+	}
+	return buf[:n], nil
+}
+
+// splitInlineArgs splits an inline command into its arguments, with the
+// same quoting rules as Redis: double quoted arguments may contain escapes
+// (such as \n or \x41), and single quoted arguments only \'.
+func splitInlineArgs(line []byte) ([]respValue, error) {
+
+	var args []respValue
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		// As with Redis, quotes may also start part way through an argument
+		arg := []byte{}
+		quote := byte(0)
+		for {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			c := line[i]
+			if quote == 0 {
+				if isInlineSpace(c) {
+					break
+				}
+				if c == '"' || c == '\'' {
+					quote = c
+				} else {
+					arg = append(arg, c)
+				}
+				i++
+				continue
+			}
+			if c == quote {
+				// The closing quote must end the argument
+				i++
+				if i < len(line) && !isInlineSpace(line[i]) {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			if c == '\\' && i+1 < len(line) {
+				if quote == '"' {
+					if n, ok := hexEscape(line[i+1:]); ok {
+						arg = append(arg, n)
+						i += 4
+						continue
+					}
+					arg = append(arg, unescape(line[i+1]))
+					i += 2
+					continue
+				}
+				if line[i+1] == '\'' {
+					arg = append(arg, '\'')
+					i += 2
+					continue
+				}
+			}
+			arg = append(arg, c)
+			i++
+		}
+		args = append(args, respBulk(arg))
+	}
+}
+
+func isInlineSpace(c byte) bool {
+
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+// hexEscape decodes an escape such as \x41, given what follows the backslash.
+func hexEscape(esc []byte) (byte, bool) {
+
+	if len(esc) < 3 || esc[0] != 'x' {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(esc[1:3]), 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(n), true
+}
+
+func unescape(c byte) byte {
+
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
+
+// readPipeline blocks until a command arrives, then also decodes any
+// further commands the client has already sent (RESP pipelining).
+// Commands decoded before an error are returned along with it.
+func readPipeline(r *bufio.Reader) ([]respValue, error) {
+
+	var reqs []respValue
+	for len(reqs) == 0 || (r.Buffered() > 0 && len(reqs) < maxPipeline) {
+		req, err := readRequest(r)
+		if err != nil {
+			return reqs, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// readRESPLine returns the next CRLF-terminated line, without the CRLF.
+func readRESPLine(r *bufio.Reader) ([]byte, error) {
+
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	// ReadSlice's buffer is only valid until the next read
+	return append([]byte(nil), line[:len(line)-2]...), nil
+}
+
+// appendRESP appends the RESP encoding of v to buf.
+func appendRESP(buf []byte, v respValue) []byte {
+
+	if v.attrs != nil {
+		buf = append(buf, respAttribute)
+		buf = strconv.AppendInt(buf, int64(len(v.attrs)/2), 10)
+		buf = append(buf, '\r', '\n')
+		for _, attr := range v.attrs {
+			buf = appendRESP(buf, attr)
+		}
+	}
+
+	buf = append(buf, v.kind)
+	switch v.kind {
+	case respSimpleString, respError, respDouble, respBoolean, respBigNumber:
+		buf = append(buf, v.str...)
+	case respInteger:
+		buf = strconv.AppendInt(buf, v.num, 10)
+	case respBulkString, respBlobError, respVerbatim:
+		if v.null {
+			return append(buf, "-1\r\n"...)
+		}
+		buf = strconv.AppendInt(buf, int64(len(v.str)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, v.str...)
+	case respArray, respMap, respSet, respPush:
+		if v.null {
+			return append(buf, "-1\r\n"...)
+		}
+		n := len(v.elems)
+		if v.kind == respMap {
+			n /= 2
+		}
+		buf = strconv.AppendInt(buf, int64(n), 10)
+		buf = append(buf, '\r', '\n')
+		for _, elem := range v.elems {
+			buf = appendRESP(buf, elem)
+		}
+		return buf
+	}
+	return append(buf, '\r', '\n')
+}
+
+// toRESP2 converts a reply for a RESP2 client, as Redis itself would
+// reply to it: maps (as keys and values in turn), sets and pushes become
+// arrays, doubles and big numbers become bulk strings, booleans become
+// 1 or 0, nulls become nil, and attributes are dropped.
+func toRESP2(v respValue) respValue {
+
+	switch v.kind {
+	case respNull:
+		return respNil()
+	case respDouble, respBigNumber:
+		return respBulk(v.str)
+	case respBoolean:
+		if string(v.str) == "t" {
+			return respInt(1)
+		}
+		return respInt(0)
+	case respVerbatim:
+		return respBulk(v.str[4:])
+	case respBlobError:
+		return respErr(string(bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return ' '
+			}
+			return r
+		}, v.str)))
+	case respArray, respMap, respSet, respPush:
+		if v.null {
+			return respValue{kind: respArray, null: true}
+		}
+		elems := make([]respValue, len(v.elems))
+		for i, elem := range v.elems {
+			elems[i] = toRESP2(elem)
+		}
+		return respArrayOf(elems...)
+	}
+	v.attrs = nil
+	return v
+}
+
+// toRESP3 converts a reply for a RESP3 client, where nil bulk
+// strings and arrays are both sent as null.
+func toRESP3(v respValue) respValue {
+
+	if v.null {
+		return respValue{kind: respNull, null: true, attrs: v.attrs}
+	}
+	switch v.kind {
+	case respArray, respMap, respSet, respPush:
+		elems := make([]respValue, len(v.elems))
+		for i, elem := range v.elems {
+			elems[i] = toRESP3(elem)
+		}
+		v.elems = elems
+	}
+	return v
+}
+
+// writeRESP writes the RESP encoding of v to w.
+func writeRESP(w io.Writer, v respValue) error {
+
+	_, err := w.Write(appendRESP(nil, v))
+	return err
+}
+
+// commandArgs validates that v is a Redis command (a non-empty array
+// of bulk strings) and returns its arguments.
+func commandArgs(v respValue) ([][]byte, error) {
+
+	if v.kind != respArray || v.null || len(v.elems) == 0 {
+		return nil, errProtocol
+	}
+	args := make([][]byte, len(v.elems))
+	for i, elem := range v.elems {
+		if elem.kind != respBulkString || elem.null {
+			return nil, errProtocol
+		}
+		args[i] = elem.str
+	}
+	return args, nil
+}
+
 // unwrapRedisKey extracts a Redis key from a RESP-formatted byte string.
 func unwrapRedisKey(key []byte) []byte {
 
-	lines := bytes.Split(key, []byte{'\r', '\n'})
+	req, err := readRESP(bufio.NewReader(bytes.NewReader(key)))
+	if err != nil {
+		return nil
+	}
+	args, err := commandArgs(req)
+	if err != nil || len(args) < 2 {
+		return nil
+	}
 
-	return lines[4]
+	return args[1]
 }
 
 // wrapRedisKey wraps a simple key into a RESP-formatted GET request.
 func wrapRedisKey(key string) string {
 
-	line4 := len(key)
-
 	// Redis GET command
-	return fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", line4, key)
+	return string(appendRESP(nil, respArrayOf(respBulk([]byte("GET")), respBulk([]byte(key)))))
 }
 
 // unwrapRedisValue extracts a Redis value from a RESP-formatted byte string.
 func unwrapRedisValue(val []byte) []byte {
 
-	lines := bytes.Split(val, []byte{'\r', '\n'})
+	reply, err := readRESP(bufio.NewReader(bytes.NewReader(val)))
+	if err != nil {
+		return nil
+	}
 
-	return lines[1]
+	return reply.str
 }
 
 // wrapRedisValue wraps a simple value into a RESP-formatted return value.
 func wrapRedisValue(val string) string {
 
-	line1 := len(val)
-
 	// Redis GET return value
-	return fmt.Sprintf("$%d\r\n%s\r\n", line1, val)
+	return string(appendRESP(nil, respBulk([]byte(val))))
 }
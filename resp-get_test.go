@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestUnwrapRedisKey(t *testing.T) {
@@ -13,6 +19,15 @@ func TestUnwrapRedisKey(t *testing.T) {
 	}
 }
 
+func TestUnwrapBinaryRedisKey(t *testing.T) {
+
+	key := unwrapRedisKey([]byte("*2\r\n$3\r\nGET\r\n$6\r\nke\r\nyt\r\n"))
+
+	if string(key) != "ke\r\nyt" {
+		t.Errorf("Expected 'ke\\r\\nyt'. Got %q", key)
+	}
+}
+
 func TestWrapRedisKey(t *testing.T) {
 
 	formattedKey := wrapRedisKey("keyt")
@@ -39,3 +54,270 @@ func TestWrapRedisValue(t *testing.T) {
 		t.Errorf("Expected '$6\r\nvaluet\r\n'. Got '%s'", returnVal)
 	}
 }
+
+func TestReadRESP(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected respValue
+	}{
+		{"+OK\r\n", respSimple("OK")},
+		{"-ERR unknown command\r\n", respErr("ERR unknown command")},
+		{":-42\r\n", respInt(-42)},
+		{"$6\r\nvaluet\r\n", respBulk([]byte("valuet"))},
+		{"$0\r\n\r\n", respBulk([]byte{})},
+		{"$-1\r\n", respNil()},
+		{"$6\r\nva\r\nue\r\n", respBulk([]byte("va\r\nue"))},
+		{"$3\r\n\x00\xff\n\r\n", respBulk([]byte{0, 0xff, '\n'})},
+		{"*-1\r\n", respValue{kind: respArray, null: true}},
+		{"*0\r\n", respValue{kind: respArray, elems: []respValue{}}},
+		{"*2\r\n$3\r\nGET\r\n$4\r\nkeyt\r\n", respArrayOf(respBulk([]byte("GET")), respBulk([]byte("keyt")))},
+		{"*2\r\n*1\r\n:1\r\n$-1\r\n", respArrayOf(respArrayOf(respInt(1)), respNil())},
+		{"_\r\n", respValue{kind: respNull, null: true}},
+		{"%1\r\n+proto\r\n:3\r\n", respMapOf(respSimple("proto"), respInt(3))},
+		{">2\r\n$10\r\ninvalidate\r\n_\r\n", respPushOf(respBulk([]byte("invalidate")), respValue{kind: respNull, null: true})},
+		{",-1.5e3\r\n", respValue{kind: respDouble, str: []byte("-1.5e3")}},
+		{",inf\r\n", respValue{kind: respDouble, str: []byte("inf")}},
+		{"#t\r\n", respValue{kind: respBoolean, str: []byte("t")}},
+		{"(3492890328409238509324850943850943825024385\r\n", respValue{kind: respBigNumber, str: []byte("3492890328409238509324850943850943825024385")}},
+		{"=8\r\ntxt:Some\r\n", respValue{kind: respVerbatim, str: []byte("txt:Some")}},
+		{"!9\r\nSYNTAX er\r\n", respValue{kind: respBlobError, str: []byte("SYNTAX er")}},
+		{"~2\r\n:1\r\n#f\r\n", respValue{kind: respSet, elems: []respValue{respInt(1), {kind: respBoolean, str: []byte("f")}}}},
+		{"|1\r\n+ttl\r\n:3\r\n$1\r\nv\r\n", respValue{kind: respBulkString, str: []byte("v"), attrs: []respValue{respSimple("ttl"), respInt(3)}}},
+	}
+
+	for _, test := range tests {
+		val, err := readRESP(bufio.NewReader(strings.NewReader(test.input)))
+		if err != nil {
+			t.Errorf("Error decoding %q: %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(val, test.expected) {
+			t.Errorf("Decoding %q expected %+v. Got %+v", test.input, test.expected, val)
+		}
+		if encoded := string(appendRESP(nil, val)); encoded != test.input {
+			t.Errorf("Expected %q. Got %q", test.input, encoded)
+		}
+	}
+}
+
+func TestRESPVersions(t *testing.T) {
+
+	null := respValue{kind: respNull, null: true}
+	reply := respPushOf(respNil(), respMapOf(respSimple("k"), null))
+
+	if encoded := string(appendRESP(nil, toRESP2(reply))); encoded != "*2\r\n$-1\r\n*2\r\n+k\r\n$-1\r\n" {
+		t.Errorf("Expected '*2\\r\\n$-1\\r\\n*2\\r\\n+k\\r\\n$-1\\r\\n'. Got %q", encoded)
+	}
+	if encoded := string(appendRESP(nil, toRESP3(reply))); encoded != ">2\r\n_\r\n%1\r\n+k\r\n_\r\n" {
+		t.Errorf("Expected '>2\\r\\n_\\r\\n%%1\\r\\n+k\\r\\n_\\r\\n'. Got %q", encoded)
+	}
+
+	// RESP3 types are replied to RESP2 clients as Redis would
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{",1.5\r\n", "$3\r\n1.5\r\n"},
+		{"#t\r\n", ":1\r\n"},
+		{"#f\r\n", ":0\r\n"},
+		{"(12345678901234567890\r\n", "$20\r\n12345678901234567890\r\n"},
+		{"=8\r\ntxt:Some\r\n", "$4\r\nSome\r\n"},
+		{"!11\r\nERR a\r\nline\r\n", "-ERR a  line\r\n"},
+		{"~1\r\n,0\r\n", "*1\r\n$1\r\n0\r\n"},
+		{"|1\r\n+ttl\r\n:3\r\n%1\r\n+k\r\n_\r\n", "*2\r\n+k\r\n$-1\r\n"},
+	}
+	for _, test := range tests {
+		val, err := readRESP(bufio.NewReader(strings.NewReader(test.input)))
+		if err != nil {
+			t.Errorf("Error decoding %q: %s", test.input, err)
+			continue
+		}
+		if encoded := string(appendRESP(nil, toRESP2(val))); encoded != test.expected {
+			t.Errorf("Converting %q expected %q. Got %q", test.input, test.expected, encoded)
+		}
+	}
+}
+
+func TestReadRESPSplitSegments(t *testing.T) {
+
+	// Two pipelined requests, delivered one byte at a time
+	input := wrapRedisKey("key\r\n1") + wrapRedisKey("key2")
+	reader := bufio.NewReader(iotest.OneByteReader(strings.NewReader(input)))
+
+	for _, expected := range []string{"key\r\n1", "key2"} {
+		req, err := readRESP(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := commandArgs(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(args[1]) != expected {
+			t.Errorf("Expected %q. Got %q", expected, args[1])
+		}
+	}
+
+	if _, err := readRESP(reader); err != io.EOF {
+		t.Errorf("Expected EOF. Got '%v'", err)
+	}
+}
+
+func TestReadRESPProtocolErrors(t *testing.T) {
+
+	tests := []string{
+		"\r\n",
+		"GET keyt\r\n",
+		"+OK\n",
+		":12a\r\n",
+		"$-2\r\n",
+		"$4\r\nkeytXX",
+		"*x\r\n",
+		"*2000000\r\n",
+	}
+
+	for _, input := range tests {
+		_, err := readRESP(bufio.NewReader(strings.NewReader(input)))
+		if err != errProtocol {
+			t.Errorf("Decoding %q expected protocol error. Got '%v'", input, err)
+		}
+	}
+
+	// A truncated value is not a protocol error
+	_, err := readRESP(bufio.NewReader(strings.NewReader("$6\r\nval")))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF. Got '%v'", err)
+	}
+}
+
+func TestReadRESPOversizedHeaders(t *testing.T) {
+
+	// Headers claiming the most Redis allows, with nothing behind them
+	tests := []struct {
+		input string
+		read  func(r *bufio.Reader) (respValue, error)
+	}{
+		{"*1048576\r\n$1\r\nx\r\n", readRESP},
+		{"%1048576\r\n", readRESP},
+		{"$536870912\r\nval", readRESP},
+		{"*1048576\r\n$3\r\nGET\r\n", readRequest},
+	}
+
+	for _, test := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := test.read(bufio.NewReader(strings.NewReader(test.input)))
+		runtime.ReadMemStats(&after)
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Errorf("Decoding %q expected EOF. Got '%v'", test.input, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+			t.Errorf("Decoding %q allocated %d bytes", test.input, allocated)
+		}
+	}
+
+	// Bulk strings spanning several chunks still arrive whole
+	value := strings.Repeat("0123456789", 20000)
+	reply, err := readRESP(bufio.NewReader(strings.NewReader(wrapRedisValue(value))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.str) != value {
+		t.Errorf("Expected a %d byte value. Got %d bytes", len(value), len(reply.str))
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+
+	_, err := commandArgs(respArrayOf(respBulk([]byte("GET")), respInt(1)))
+	if err != errProtocol {
+		t.Errorf("Expected protocol error. Got '%v'", err)
+	}
+
+	_, err = commandArgs(respArrayOf())
+	if err != errProtocol {
+		t.Errorf("Expected protocol error. Got '%v'", err)
+	}
+
+	args, err := commandArgs(respArrayOf(respBulk([]byte("GET")), respBulk([]byte("keyt"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 || string(args[0]) != "GET" || string(args[1]) != "keyt" {
+		t.Errorf("Expected [GET keyt]. Got %q", args)
+	}
+}
+
+func TestSplitInlineArgs(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"GET keyt", []string{"GET", "keyt"}},
+		{"  get\tkeyt  ", []string{"get", "keyt"}},
+		{"", nil},
+		{`SET "a key" 'a value'`, []string{"SET", "a key", "a value"}},
+		{`SET k "line\r\n\x41\"\\"`, []string{"SET", "k", "line\r\nA\"\\"}},
+		{`SET k 'it\'s \n'`, []string{"SET", "k", `it's \n`}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`SET k foo"bar baz"`, []string{"SET", "k", "foobar baz"}},
+	}
+	for _, test := range tests {
+		args, err := splitInlineArgs([]byte(test.input))
+		if err != nil {
+			t.Errorf("Error splitting %q: %s", test.input, err)
+			continue
+		}
+		var strs []string
+		for _, arg := range args {
+			strs = append(strs, string(arg.str))
+		}
+		if !reflect.DeepEqual(strs, test.expected) {
+			t.Errorf("Splitting %q expected %q. Got %q", test.input, test.expected, strs)
+		}
+	}
+
+	for _, input := range []string{`GET "keyt`, `GET 'keyt`, `GET "key"t`} {
+		if _, err := splitInlineArgs([]byte(input)); err != errUnbalancedQuotes {
+			t.Errorf("Splitting %q expected unbalanced quotes. Got %v", input, err)
+		}
+	}
+}
+
+func TestReadPipeline(t *testing.T) {
+
+	input := wrapRedisKey("key1") + wrapRedisKey("key2") + wrapRedisKey("key3")
+	reader := bufio.NewReader(strings.NewReader(input))
+
+	reqs, err := readPipeline(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 3 {
+		t.Fatalf("Expected 3 pipelined requests. Got %d", len(reqs))
+	}
+	if key := unwrapRedisKey(appendRESP(nil, reqs[2])); string(key) != "key3" {
+		t.Errorf("Expected 'key3'. Got '%s'", key)
+	}
+
+	if _, err = readPipeline(reader); err != io.EOF {
+		t.Errorf("Expected EOF. Got '%v'", err)
+	}
+
+	// Commands may only hold bulk strings, not nest other values
+	nested := strings.Repeat("*1\r\n", 100000) + "$4\r\nPING\r\n"
+	for _, input := range []string{nested, "*2\r\n$3\r\nGET\r\n:1\r\n"} {
+		if _, err := readPipeline(bufio.NewReader(strings.NewReader(input))); err != errProtocol {
+			t.Errorf("Decoding %.20q expected protocol error. Got '%v'", input, err)
+		}
+	}
+
+	// Requests decoded before a protocol error are still returned
+	reader = bufio.NewReader(strings.NewReader(wrapRedisKey("key1") + "*x\r\n"))
+	reqs, err = readPipeline(reader)
+	if err != errProtocol || len(reqs) != 1 {
+		t.Errorf("Expected 1 request and protocol error. Got %d and '%v'", len(reqs), err)
+	}
+}
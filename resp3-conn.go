@@ -0,0 +1,166 @@
+// resp3-conn handles the upstream connections which have negotiated RESP3, reading their replies as sent.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// The RESP protocol version spoken to the upstream Redis (2 or 3)
+var upstreamProtocol = 2
+
+// resp3Conn is an upstream connection which has negotiated RESP3. The
+// upstream client only speaks RESP2, so the replies it reads itself (such
+// as to the pool's PINGs) are translated to RESP2 for it, but pipelines
+// are sent and read here instead (see roundTrip), keeping their types.
+type resp3Conn struct {
+	net.Conn
+	r      *bufio.Reader // over the Conn, decoding each reply as it arrives
+	out    []byte        // translated, but not yet read
+	err    error         // once a reply is cut short, nothing more can be read
+	client *redis.Client
+}
+
+// The RESP3 connections, by the upstream client over each
+var resp3Conns = make(map[*redis.Client]*resp3Conn)
+var resp3ConnsLock sync.Mutex
+
+func newRESP3Conn(conn net.Conn) *resp3Conn {
+
+	return &resp3Conn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// resp3ConnOf returns the RESP3 connection of the client, if it has one.
+func resp3ConnOf(client *redis.Client) *resp3Conn {
+
+	resp3ConnsLock.Lock()
+	defer resp3ConnsLock.Unlock()
+
+	return resp3Conns[client]
+}
+
+func (c *resp3Conn) Close() error {
+
+	resp3ConnsLock.Lock()
+	delete(resp3Conns, c.client)
+	resp3ConnsLock.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *resp3Conn) Read(p []byte) (int, error) {
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.out) == 0 {
+		// Waiting for a reply may simply time out (and be retried), but
+		// once it has started to arrive it must be read in full
+		if _, err := c.r.Peek(1); err != nil {
+			return 0, err
+		}
+		reply, err := readRESP(c.r)
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+		c.out = appendRESP(nil, toRESP2(reply))
+	}
+
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// dialRESP3 connects to the upstream Redis, negotiating RESP3 with HELLO.
+func dialRESP3(addr string, timeout time.Duration) (*redis.Client, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := newRESP3Conn(conn)
+	client, err := redis.NewClient(rc)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.ReadTimeout = timeout
+	client.WriteTimeout = timeout
+
+	rc.client = client
+	resp3ConnsLock.Lock()
+	resp3Conns[client] = rc
+	resp3ConnsLock.Unlock()
+
+	if err = client.Cmd("HELLO", 3).Err; err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// roundTrip pipelines the commands, reading their replies as RESP3. As
+// with the upstream client, a connection which fails is closed (and so
+// isn't put back in its pool).
+func (c *resp3Conn) roundTrip(client *redis.Client, cmds []upstreamCmd) []respValue {
+
+	replies := make([]respValue, len(cmds))
+	err := c.err
+	if err == nil {
+		var req []byte
+		for _, cmd := range cmds {
+			req = appendRESP(req, cmd.request())
+		}
+		if client.WriteTimeout != 0 {
+			c.SetWriteDeadline(time.Now().Add(client.WriteTimeout))
+		}
+		_, err = c.Conn.Write(req)
+	}
+	if err == nil && client.ReadTimeout != 0 {
+		c.SetReadDeadline(time.Now().Add(client.ReadTimeout))
+	}
+
+	read := 0
+	for read < len(replies) && err == nil {
+		var reply respValue
+		reply, err = readRESP(c.r)
+		// Out of band pushes (such as invalidations) aren't replies
+		if err == nil && reply.kind != respPush {
+			replies[read] = reply
+			read++
+		}
+	}
+	if err != nil {
+		c.err = err
+		client.LastCritical = err
+		client.Close()
+		for i := read; i < len(replies); i++ {
+			replies[i] = respUnavailable(err)
+		}
+	}
+	return replies
+}
+
+// request encodes the command as it is sent to Redis, with its
+// arguments (of the types passed to the upstream client) as bulk strings.
+func (c upstreamCmd) request() respValue {
+
+	elems := []respValue{respBulk([]byte(c.cmd))}
+	for _, arg := range c.args {
+		switch arg := arg.(type) {
+		case []byte:
+			elems = append(elems, respBulk(arg))
+		case string:
+			elems = append(elems, respBulk([]byte(arg)))
+		default:
+			elems = append(elems, respBulk([]byte(fmt.Sprint(arg))))
+		}
+	}
+	return respArrayOf(elems...)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRESP3Conn(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Replies may arrive in pieces (here, a large value in small ones)
+	large := strings.Repeat("v", 4*1024*1024)
+	go func() {
+		server.Write([]byte("%1\r\n$1\r\nk\r\n=8\r\ntxt:So"))
+		server.Write([]byte("me\r\n:1\r\n"))
+		encoded := appendRESP(nil, respValue{kind: respVerbatim, str: []byte("txt:" + large)})
+		for len(encoded) > 0 {
+			n := 1000
+			if n > len(encoded) {
+				n = len(encoded)
+			}
+			server.Write(encoded[:n])
+			encoded = encoded[n:]
+		}
+		server.Write([]byte("?\r\n"))
+	}()
+
+	// And are read as RESP2
+	r := bufio.NewReader(newRESP3Conn(client))
+	for _, expected := range []string{"*2\r\n$1\r\nk\r\n$4\r\nSome\r\n", ":1\r\n", "$4194304\r\n" + large + "\r\n"} {
+		reply, err := readRESP(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded := string(appendRESP(nil, reply)); encoded != expected {
+			t.Errorf("Expected %.40q. Got %.40q", expected, encoded)
+		}
+	}
+
+	if _, err := readRESP(r); err != errProtocol {
+		t.Errorf("Expected a protocol error. Got %v", err)
+	}
+}
+
+func TestRESP3Upstream(t *testing.T) {
+
+	// Stand-in RESP3 upstream
+	upstream := startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "HELLO":
+			return []respValue{respMapOf(respBulk([]byte("proto")), respInt(3))}
+		case "HGETALL":
+			return []respValue{respMapOf(respBulk([]byte("field")), respBulk([]byte("value")))}
+		case "ZSCORE":
+			return []respValue{{kind: respDouble, str: []byte("1.5")}}
+		}
+		return []respValue{{kind: respNull, null: true}}
+	})
+	defer upstream.close()
+
+	upstreamProtocol = 3
+	defer func() { upstreamProtocol = 2 }()
+
+	client, err := createRedisClient(upstream.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	hash, err := client.Cmd("HGETALL", "hash").Map()
+	if err != nil || hash["field"] != "value" {
+		t.Errorf("Expected map[field:value]. Got %v and %v", hash, err)
+	}
+	score, err := client.Cmd("ZSCORE", "zset", "member").Float64()
+	if err != nil || score != 1.5 {
+		t.Errorf("Expected '1.5'. Got '%f' and %v", score, err)
+	}
+	if _, err = client.Cmd("GET", "doesNotExist").Str(); err == nil {
+		t.Errorf("Expected nil")
+	}
+}
+
+func TestRESP3RoundTrip(t *testing.T) {
+
+	config := respMapOf(respBulk([]byte("maxmemory")), respBulk([]byte("0")))
+	scores := respArrayOf(respValue{kind: respDouble, str: []byte("1.5")}, respValue{kind: respNull, null: true})
+	info := respMapOf(respBulk([]byte("length")), respInt(1), respBulk([]byte("groups")), respInt(0))
+
+	// Stand-in RESP3 upstream, which also pushes an invalidation
+	upstream := startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "HELLO":
+			return []respValue{respMapOf(respBulk([]byte("proto")), respInt(3))}
+		case "CONFIG":
+			return []respValue{config}
+		case "ZMSCORE":
+			return []respValue{respPushOf(respBulk([]byte("invalidate")), respCommand("key1")), scores}
+		case "XINFO":
+			return []respValue{info}
+		}
+		return []respValue{respErr("ERR unknown command")}
+	})
+	defer upstream.close()
+
+	client, err := dialUpstream(upstream.addr(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Pipelined replies keep their RESP3 types
+	replies := roundTrip(client, []upstreamCmd{
+		{cmd: "CONFIG", args: []interface{}{"GET", "maxmemory"}},
+		{cmd: "ZMSCORE", args: []interface{}{[]byte("zset"), "m1", "m2"}},
+		{cmd: "XINFO", args: []interface{}{"STREAM", "stream"}},
+	})
+	for i, expected := range []respValue{config, scores, info} {
+		if !reflect.DeepEqual(replies[i], expected) {
+			t.Errorf("Expected %q. Got %q", appendRESP(nil, expected), appendRESP(nil, replies[i]))
+		}
+	}
+
+	// Once the connection is lost, it is closed
+	upstream.close()
+	replies = roundTrip(client, []upstreamCmd{{cmd: "XINFO", args: []interface{}{"STREAM", "stream"}}})
+	if replies[0].err == nil || client.LastCritical == nil {
+		t.Errorf("Expected a connection error. Got %q", appendRESP(nil, replies[0]))
+	}
+	if resp3ConnOf(client) != nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
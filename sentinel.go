@@ -0,0 +1,199 @@
+// sentinel handles the discovery of the upstream master through Redis Sentinel, following it as it fails over.
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/sentinel"
+)
+
+// errNoMaster is returned when the sentinels' master is not (or no longer) a master.
+var errNoMaster = errors.New("no master found through Sentinel")
+
+// Whether to flush the cache when Sentinel fails the master over (as
+// writes which hadn't yet reached a replica are lost)
+var flushOnSwitch = false
+
+// sentinelPool is a pool of connections to the master monitored by the
+// sentinels under the given name, which switches as it is failed over.
+type sentinelPool struct {
+	addrs     []string // of the sentinels
+	name      string
+	size      int
+	client    *sentinel.Client
+	master    string // the address of the master last connected to
+	following bool   // whether switches of master are to be acted on
+	lock      sync.Mutex
+}
+
+var switchLock sync.Mutex
+
+// createSentinelPool finds the master from the first available sentinel;
+// if none is, the sentinels are tried again as connections are needed.
+func createSentinelPool(addrs []string, name string, size int) (*sentinelPool, error) {
+
+	p := &sentinelPool{addrs: addrs, name: name, size: size}
+	defer func() {
+		p.lock.Lock()
+		p.following = true
+		p.lock.Unlock()
+	}()
+
+	client, err := p.Get()
+	if err != nil {
+		return p, err
+	}
+	p.Put(client)
+	return p, nil
+}
+
+// sentinelClient returns the current sentinel client, or connects one.
+func (p *sentinelPool) sentinelClient() (*sentinel.Client, error) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+	var err error
+	for _, addr := range p.addrs {
+		var client *sentinel.Client
+		client, err = sentinel.NewClientCustom("tcp", addr, p.size, upstreamDialer(), p.name)
+		if err == nil {
+			p.client = client
+			return client, nil
+		}
+		log.Printf("Sentinel '%s' unavailable, error: %s\n", addr, err)
+	}
+	return nil, err
+}
+
+// Get returns a connection to the current master.
+func (p *sentinelPool) Get() (*redis.Client, error) {
+
+	client, err := p.sentinelClient()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i <= p.size; i++ {
+		conn, err := client.GetMaster(p.name)
+		if err != nil {
+			// The vendored client can't be closed, so a lost one is just dropped
+			if clientErr, ok := err.(*sentinel.ClientError); ok && clientErr.SentinelErr {
+				p.lock.Lock()
+				if p.client == client {
+					p.client = nil
+				}
+				p.lock.Unlock()
+			}
+			return nil, err
+		}
+
+		// A connection put back as the master switched may be to the old one
+		if conn.Addr != p.masterAddr() && !isMaster(conn) {
+			conn.Close()
+			continue
+		}
+		p.noteMaster(conn.Addr)
+		return conn, nil
+	}
+	return nil, errNoMaster
+}
+
+// Put returns a connection to the pool, unless the master has since switched.
+func (p *sentinelPool) Put(conn *redis.Client) {
+
+	p.lock.Lock()
+	client, master := p.client, p.master
+	p.lock.Unlock()
+
+	if client == nil || conn.Addr != master {
+		conn.Close()
+		return
+	}
+	client.PutMaster(p.name, conn)
+}
+
+func (p *sentinelPool) Cmd(cmd string, args ...interface{}) *redis.Resp {
+
+	conn, err := p.Get()
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer p.Put(conn)
+
+	return conn.Cmd(cmd, args...)
+}
+
+// Avail is always 0, as the sentinel client replaces the pool itself
+// when the master switches.
+func (p *sentinelPool) Avail() int {
+
+	return 0
+}
+
+// Empty does nothing, as the vendored sentinel client can't be closed.
+func (p *sentinelPool) Empty() {
+}
+
+func (p *sentinelPool) masterAddr() string {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.master
+}
+
+func (p *sentinelPool) noteMaster(addr string) {
+
+	p.lock.Lock()
+	previous := p.master
+	p.master = addr
+	following := p.following
+	p.lock.Unlock()
+
+	if following && previous != addr {
+		masterSwitched(addr)
+	}
+}
+
+// masterSwitched optionally flushes the cache, and moves any listeners
+// for invalidations to the new master.
+func masterSwitched(addr string) {
+
+	switchLock.Lock()
+	defer switchLock.Unlock()
+
+	log.Printf("Upstream master switched to '%s'\n", addr)
+	if flushOnSwitch {
+		invalidateAll()
+	}
+	if notificationsStop != nil {
+		stopNotificationListener()
+		startNotificationListener(addr)
+	}
+	if trackingStop != nil {
+		stopTrackingListener()
+		startTrackingListener(addr, trackedPrefixes)
+	}
+}
+
+// isMaster reports whether the connection is to a master, according to
+// ROLE (which, if unsupported, is assumed).
+func isMaster(conn *redis.Client) bool {
+
+	resp := conn.Cmd("ROLE")
+	if resp.IsType(redis.AppErr) {
+		return true
+	}
+	elems, err := resp.Array()
+	if err != nil || len(elems) == 0 {
+		return false
+	}
+	role, err := elems[0].Str()
+	return err == nil && role == "master"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startStandInSentinel starts a stand-in sentinel, monitoring the master
+// at the address returned by master under the name 'mymaster'.
+func startStandInSentinel(t *testing.T, master func() string) *standIn {
+
+	return startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "SENTINEL":
+			if len(args) != 3 || string(args[2]) != "mymaster" {
+				return []respValue{respErr("ERR No such master with that name")}
+			}
+			host, port, _ := net.SplitHostPort(master())
+			return []respValue{respCommand("name", "mymaster", "ip", host, "port", port, "flags", "master")}
+		case "SUBSCRIBE":
+			return []respValue{respArrayOf(respBulk([]byte("subscribe")), respBulk(args[1]), respInt(1))}
+		case "PING":
+			return []respValue{respCommand("pong", "")}
+		}
+		return []respValue{respErr("ERR unknown command")}
+	})
+}
+
+// startStandInMaster starts a stand-in upstream whose GETs return its
+// name, and whose ROLE is the role returned by role.
+func startStandInMaster(t *testing.T, name string, role func() string) *standIn {
+
+	return startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "GET":
+			return []respValue{respBulk([]byte(name))}
+		case "ROLE":
+			return []respValue{respArrayOf(respBulk([]byte(role())))}
+		}
+		return []respValue{respSimple("OK")}
+	})
+}
+
+func TestSentinelFailover(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	var lock sync.Mutex
+	failedOver := false
+	role := func(master bool) func() string {
+		return func() string {
+			lock.Lock()
+			defer lock.Unlock()
+			if master != failedOver {
+				return "master"
+			}
+			return "slave"
+		}
+	}
+	oldMaster := startStandInMaster(t, "fromOldMaster", role(true))
+	defer oldMaster.close()
+	newMaster := startStandInMaster(t, "fromNewMaster", role(false))
+	defer newMaster.close()
+
+	sentinel := startStandInSentinel(t, func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		if failedOver {
+			return newMaster.addr()
+		}
+		return oldMaster.addr()
+	})
+	defer sentinel.close()
+
+	flushOnSwitch = true
+	defer func() { flushOnSwitch = false }()
+
+	// The first sentinel is down, so the next is used
+	sentinelPool, err := createSentinelPool([]string{"localhost:1", sentinel.addr()}, "mymaster", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := sentinelPool.masterAddr(); addr != oldMaster.addr() {
+		t.Errorf("Expected master '%s'. Got '%s'", oldMaster.addr(), addr)
+	}
+
+	backendPool := redisPool
+	redisPool = sentinelPool
+	defer func() { redisPool = backendPool }()
+
+	if val, err := getRedisValue("sentinelKey"); val != "fromOldMaster" || err != nil {
+		t.Errorf("Expected 'fromOldMaster'. Got '%s' and %v", val, err)
+	}
+
+	// Fail the master over, which flushes the cache
+	lock.Lock()
+	failedOver = true
+	lock.Unlock()
+	host, port, _ := net.SplitHostPort(newMaster.addr())
+	oldHost, oldPort, _ := net.SplitHostPort(oldMaster.addr())
+	sentinel.push(respCommand("message", "+switch-master", strings.Join([]string{"mymaster", oldHost, oldPort, host, port}, " ")))
+
+	timeout := time.After(5 * time.Second)
+	for {
+		val, _ := getRedisValue("sentinelProbe")
+		if val == "fromNewMaster" {
+			break
+		}
+		redisCache.lru.Remove(getCacheKey("sentinelProbe"))
+		select {
+		case <-timeout:
+			t.Fatalf("Expected 'fromNewMaster'. Got '%s'", val)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if _, found := getCachedValue("sentinelKey"); found {
+		t.Errorf("Expected 'sentinelKey' to be flushed")
+	}
+	if addr := sentinelPool.masterAddr(); addr != newMaster.addr() {
+		t.Errorf("Expected master '%s'. Got '%s'", newMaster.addr(), addr)
+	}
+	if val, err := getRedisValue("sentinelKey"); val != "fromNewMaster" || err != nil {
+		t.Errorf("Expected 'fromNewMaster'. Got '%s' and %v", val, err)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
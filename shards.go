@@ -0,0 +1,124 @@
+// shards handles sharding keys across independent upstream masters, placed on a consistent-hash ring.
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/radix.v2/pool"
+)
+
+// ringPoint is one of the points (virtual nodes) a node has on a hash ring.
+type ringPoint struct {
+	hash uint32
+	node string
+}
+
+// hashRing places nodes at points around a ring, sorted by hash, each key
+// being owned by the node at the next point. Adding a node only moves the
+// keys falling just before its points.
+type hashRing []ringPoint
+
+// newHashRing places each node at vnodes points per unit of its weight.
+func newHashRing(nodes []string, weights []int, vnodes int) hashRing {
+
+	var ring hashRing
+	for n, node := range nodes {
+		for i := 0; i < vnodes*weights[n]; i++ {
+			ring = append(ring, ringPoint{ringHash(node + "-" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			return ring[i].node < ring[j].node
+		}
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// node returns the node owning the key (or, as with Redis Cluster, the
+// part of it between the first '{' and '}', so that related keys can be
+// kept together).
+func (ring hashRing) node(key string) string {
+
+	h := ringHash(hashTag(key))
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].node
+}
+
+func hashTag(key string) string {
+
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+func ringHash(s string) uint32 {
+
+	sum := md5.Sum([]byte(s))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+// The ring of upstream masters keys are sharded across (nil unless
+// sharding), and pools of connections to them
+var shardRing hashRing
+var shardPools map[string]*pool.Pool
+
+// startShards opens pools of connections to the shards (which may not be
+// up yet) and places them on the ring.
+func startShards(addrs []string, weights []int, vnodes int, size int) {
+
+	shardPools = make(map[string]*pool.Pool)
+	for _, addr := range addrs {
+		p, err := createRedisPool(addr, size)
+		if err != nil {
+			log.Printf("Error on shard connection to '%s' error: %s\n", addr, err)
+			noteUpstream(false)
+		}
+		shardPools[addr] = p
+	}
+	shardRing = newHashRing(addrs, weights, vnodes)
+}
+
+func stopShards() {
+
+	for _, p := range shardPools {
+		p.Empty()
+	}
+	shardRing, shardPools = nil, nil
+}
+
+// shardFetch pipelines the commands for each shard to it, all at once.
+func (p *upstreamPipeline) shardFetch() ([]respValue, bool) {
+
+	return p.fanOutFetch(func(cmds []upstreamCmd) ([]respValue, bool) {
+		split := upstreamPipeline{cmds: cmds}
+		return split.splitFetch(shardRing.node, func(key string, cmds []nodeCmd) ([]respValue, bool) {
+			return fetchFrom(shardPools[shardRing.node(key)], upstreamCmds(cmds))
+		})
+	}, fetchFromEveryShard)
+}
+
+// fetchFromEveryShard sends the command to every shard.
+func fetchFromEveryShard(c upstreamCmd) (respValue, bool) {
+
+	var resps []respValue
+	sent := false
+	for _, p := range shardPools {
+		shardResps, shardSent := fetchFrom(p, []upstreamCmd{c})
+		resps = append(resps, shardResps[0])
+		sent = sent || shardSent
+	}
+	return joinEvery(resps), sent
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	owned := func(ring hashRing) map[string]int {
+		counts := make(map[string]int)
+		for _, key := range keys {
+			counts[ring.node(key)]++
+		}
+		return counts
+	}
+
+	// Keys are spread in proportion to the weights
+	ring := newHashRing([]string{"a", "b"}, []int{1, 2}, 160)
+	if counts := owned(ring); counts["a"] < 2800 || counts["a"] > 3900 {
+		t.Errorf("Expected about a third of the keys on 'a'. Got %v", counts)
+	}
+
+	// Adding a node only moves keys to it, about a quarter of them
+	grown := newHashRing([]string{"a", "b", "c"}, []int{1, 2, 1}, 160)
+	moved := 0
+	for _, key := range keys {
+		if node := grown.node(key); node != ring.node(key) {
+			moved++
+			if node != "c" {
+				t.Fatalf("Expected '%s' to stay on '%s' or move to 'c'. Got '%s'", key, ring.node(key), node)
+			}
+		}
+	}
+	if moved < 1900 || moved > 3100 {
+		t.Errorf("Expected about a quarter of the keys to move. Got %d", moved)
+	}
+
+	// Keys with the same hash tag are kept together
+	for _, key := range keys[:100] {
+		if ring.node("{user1}"+key) != ring.node("user1") {
+			t.Errorf("Expected '{user1}%s' to be on '%s'", key, ring.node("user1"))
+		}
+	}
+}
+
+// startStandInShard starts a stand-in master whose GETs return its name
+// and the key, and which otherwise answers as a Redis master would.
+func startStandInShard(t *testing.T, name string) *standIn {
+
+	return startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "GET":
+			return []respValue{respBulk([]byte(name + ":" + string(args[1])))}
+		case "DEL", "EXISTS":
+			return []respValue{respInt(int64(len(args) - 1))}
+		case "PING":
+			return []respValue{respSimple("PONG")}
+		}
+		return []respValue{respSimple("OK")}
+	})
+}
+
+func TestShardRouting(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	shard0 := startStandInShard(t, "shard0")
+	defer shard0.close()
+	shard1 := startStandInShard(t, "shard1")
+	defer shard1.close()
+
+	startShards([]string{shard0.addr(), shard1.addr()}, []int{1, 1}, 160, 2)
+	defer stopShards()
+
+	// Find a key on each shard
+	var keys [2]string
+	for i := 0; keys[0] == "" || keys[1] == ""; i++ {
+		key := "shardKey" + strconv.Itoa(i)
+		if shardRing.node(key) == shard0.addr() {
+			keys[0] = key
+		} else {
+			keys[1] = key
+		}
+	}
+
+	vals, errs := getRedisMultiValues([]string{keys[0], keys[1]})
+	for i, expected := range []string{"shard0:" + keys[0], "shard1:" + keys[1]} {
+		if vals[i] != expected || errs[i] != nil {
+			t.Errorf("Expected '%s'. Got '%s' and %v", expected, vals[i], errs[i])
+		}
+	}
+	if val, err := getRedisValue(keys[1] + "{" + keys[0] + "}"); val != "shard0:"+keys[1]+"{"+keys[0]+"}" || err != nil {
+		t.Errorf("Expected the hash tag to be on shard0. Got '%s' and %v", val, err)
+	}
+
+	// Multi-key commands are split across the shards, and their replies joined
+	request := fmt.Sprintf("DEL %[1]s %[2]s %[1]s\r\nMSET %[1]s 1 %[2]s 2\r\nRENAME %[1]s %[2]s\r\nRENAME %[1]s {%[1]s}2\r\nPING\r\n", keys[0], keys[1])
+	expected := ":3\r\n+OK\r\n-CROSSSLOT Keys in request don't hash to the same slot\r\n+OK\r\n+PONG\r\n+OK\r\n"
+	if buf := sendTCP(t, request+quitRequest); string(buf) != expected {
+		t.Errorf("Expected %q. Got %q", expected, buf)
+	}
+
+	// The MSET reaches each shard as a SET
+	for _, shard := range []*standIn{shard0, shard1} {
+		shard.waitFor(t, "SET")
+	}
+
+	// Commands changing every key reach every shard, while those reading every key are refused
+	expected = "+OK\r\n-ERR 'dbsize' would only cover one node, so is not supported through this proxy\r\n+OK\r\n"
+	if buf := sendTCP(t, "FLUSHDB\r\nDBSIZE\r\n"+quitRequest); string(buf) != expected {
+		t.Errorf("Expected %q. Got %q", expected, buf)
+	}
+	for _, shard := range []*standIn{shard0, shard1} {
+		shard.waitFor(t, "FLUSHDB")
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
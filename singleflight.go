@@ -0,0 +1,96 @@
+// singleflight handles the coalescing of concurrent cache misses for the same reply.
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// flight is an upstream fetch of a reply, which concurrent cache misses
+// for the same reply wait for rather than each fetching it themselves.
+type flight struct {
+	done  chan bool
+	reply respValue
+}
+
+var flights = make(map[cacheKey]*flight)
+var flightsLock sync.Mutex
+
+// The number of cache misses which waited for another's fetch (published
+// with the other expvar variables, for example at /debug/vars over HTTP)
+var collapsedRequests = expvar.NewInt("collapsedRequests")
+
+// joinFlight returns the fetch in flight for the reply, or starts one.
+// If it was started (it returns true) the caller must fetch the reply
+// and land the flight; otherwise the caller waits for it.
+func joinFlight(ck cacheKey) (*flight, bool) {
+
+	flightsLock.Lock()
+	defer flightsLock.Unlock()
+
+	if f, ok := flights[ck]; ok {
+		collapsedRequests.Add(1)
+		return f, false
+	}
+	f := &flight{done: make(chan bool)}
+	flights[ck] = f
+	return f, true
+}
+
+// land shares the upstream reply with the cache misses waiting for it.
+func (f *flight) land(ck cacheKey, reply respValue) {
+
+	flightsLock.Lock()
+	if flights[ck] == f {
+		delete(flights, ck)
+	}
+	flightsLock.Unlock()
+
+	f.reply = reply
+	close(f.done)
+}
+
+func (f *flight) wait() respValue {
+
+	<-f.done
+	return f.reply
+}
+
+// dropFlights stops later cache misses for the keys (or for all keys)
+// joining the fetches in flight, which may have started before a write.
+func dropFlights(keys []string, all bool) {
+
+	flightsLock.Lock()
+	defer flightsLock.Unlock()
+
+	if all {
+		flights = make(map[cacheKey]*flight)
+		return
+	}
+	for _, key := range keys {
+		for ck := range flights {
+			if ck.key == key {
+				delete(flights, ck)
+			}
+		}
+	}
+}
+
+// joinFlights joins (or starts) the fetch of each missed GET, returning
+// the indexes of the keys to fetch and the flights for the others.
+func joinFlights(keys []string, misses []int) ([]int, map[int]*flight, []*flight) {
+
+	var fetches []int
+	var led []*flight
+	joined := make(map[int]*flight)
+	for _, i := range misses {
+		f, lead := joinFlight(getCacheKey(keys[i]))
+		if lead {
+			fetches = append(fetches, i)
+			led = append(led, f)
+			continue
+		}
+		joined[i] = f
+	}
+	return fetches, joined, led
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// useSlowUpstream swaps in a slow stand-in upstream, returning a
+// function to restore the backend.
+func useSlowUpstream(t *testing.T, release chan bool, gets *int64) func() {
+
+	upstream := startSlowUpstream(t, release, gets)
+	slowPool, err := createRedisPool(upstream.addr(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backendPool := redisPool
+	redisPool = slowPool
+	return func() {
+		redisPool = backendPool
+		slowPool.Empty()
+		upstream.close()
+	}
+}
+
+// startSlowUpstream starts a stand-in upstream whose GETs (and MGETs)
+// wait for release, counting how many of each it receives.
+func startSlowUpstream(t *testing.T, release chan bool, gets *int64) *standIn {
+
+	return startStandIn(t, func(args [][]byte) []respValue {
+		name := strings.ToUpper(string(args[0]))
+		if name != "GET" && name != "MGET" {
+			return []respValue{respSimple("OK")}
+		}
+		atomic.AddInt64(gets, 1)
+		<-release
+
+		var elems []respValue
+		for _, arg := range args[1:] {
+			switch string(arg) {
+			case "hotKey":
+				elems = append(elems, respBulk([]byte("hotValue")))
+			case "hotList":
+				elems = append(elems, respErr("WRONGTYPE Operation against a key holding the wrong kind of value"))
+			default:
+				elems = append(elems, respNil())
+			}
+		}
+		if name == "MGET" {
+			return []respValue{respArrayOf(elems...)}
+		}
+		return elems
+	})
+}
+
+// waitForCollapsed waits (for up to 5 seconds) until n more requests have been collapsed.
+func waitForCollapsed(t *testing.T, from int64, n int64) {
+
+	timeout := time.After(5 * time.Second)
+	for collapsedRequests.Value() < from+n {
+		select {
+		case <-timeout:
+			t.Fatalf("Expected %d collapsed requests. Got %d", n, collapsedRequests.Value()-from)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestCollapsedMisses(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	// Values, nils and errors are all shared
+	tests := []struct {
+		key string
+		val string
+		err string
+	}{
+		{"hotKey", "hotValue", ""},
+		{"hotNil", "", redis.ErrRespNil.Error()},
+		{"hotList", "", "WRONGTYPE Operation against a key holding the wrong kind of value"},
+	}
+	for _, test := range tests {
+		release := make(chan bool)
+		var gets int64
+		restore := useSlowUpstream(t, release, &gets)
+		collapsed := collapsedRequests.Value()
+
+		var wg sync.WaitGroup
+		vals := make([]string, 10)
+		errs := make([]error, 10)
+		for i := range vals {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				vals[i], errs[i] = getRedisValue(test.key)
+			}(i)
+		}
+		waitForCollapsed(t, collapsed, 9)
+		close(release)
+		wg.Wait()
+		restore()
+
+		if n := atomic.LoadInt64(&gets); n != 1 {
+			t.Errorf("Expected 1 upstream GET of '%s'. Got %d", test.key, n)
+		}
+		for i := range vals {
+			err := ""
+			if errs[i] != nil {
+				err = errs[i].Error()
+			}
+			if vals[i] != test.val || err != test.err {
+				t.Errorf("Expected '%s' and '%s'. Got '%s' and '%s'", test.val, test.err, vals[i], err)
+			}
+		}
+	}
+
+	// Only the leader caches the value
+	if cacheSize := redisCache.lru.Len(); cacheSize != 1 {
+		t.Errorf("Expected cache size '1'. Got '%d'", cacheSize)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestCollapsedMissesTCP(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	release := make(chan bool)
+	var gets int64
+	defer useSlowUpstream(t, release, &gets)()
+
+	collapsed := collapsedRequests.Value()
+	leader := dialTest(t)
+	defer leader.conn.Close()
+	if _, err := leader.conn.Write(appendRESP(nil, respCommand("GET", "hotKey"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting for the leader's fetch, while fetching another key
+	waiter := dialTest(t)
+	defer waiter.conn.Close()
+	if _, err := waiter.conn.Write(appendRESP(appendRESP(nil, respCommand("GET", "hotKey")), respCommand("MGET", "hotKey", "hotNil"))); err != nil {
+		t.Fatal(err)
+	}
+	waitForCollapsed(t, collapsed, 2)
+	close(release)
+
+	if reply := leader.read(t); string(reply.str) != "hotValue" {
+		t.Errorf("Expected 'hotValue'. Got %q", appendRESP(nil, reply))
+	}
+	if reply := waiter.read(t); string(reply.str) != "hotValue" {
+		t.Errorf("Expected 'hotValue'. Got %q", appendRESP(nil, reply))
+	}
+	expected := "*2\r\n$8\r\nhotValue\r\n$-1\r\n"
+	if reply := waiter.read(t); string(appendRESP(nil, reply)) != expected {
+		t.Errorf("Expected %q. Got %q", expected, appendRESP(nil, reply))
+	}
+	if n := atomic.LoadInt64(&gets); n != 2 {
+		t.Errorf("Expected 2 upstream fetches. Got %d", n)
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
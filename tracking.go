@@ -0,0 +1,175 @@
+// tracking handles the invalidation of cached replies by Redis 6 client-side caching (CLIENT TRACKING).
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Redis sends invalidation messages to this channel of the redirect connection
+const invalidateChannel = "__redis__:invalidate"
+
+// errTrackingUnsupported is returned when the upstream rejects CLIENT
+// TRACKING (as Redis before 6.0 and other caching proxies do).
+var errTrackingUnsupported = errors.New("upstream does not support CLIENT TRACKING")
+
+var trackingStop chan bool
+
+// The prefixes tracked, so that tracking can be moved to a new master
+var trackedPrefixes []string
+
+// The current tracking connections, so that they can be closed on stopping
+var trackingClients []*redis.Client
+var trackingLock sync.Mutex
+
+// startTrackingListener has the upstream broadcast an invalidation message
+// whenever a key (starting with one of the prefixes, if any) changes. If
+// the upstream doesn't support tracking, cached replies simply expire.
+func startTrackingListener(addr string, prefixes []string) {
+
+	stop := make(chan bool)
+	trackingStop = stop
+	trackedPrefixes = prefixes
+	go func() {
+		for retry := 0; ; retry++ {
+			started := time.Now()
+			err := listenForInvalidations(addr, prefixes)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err == errTrackingUnsupported {
+				log.Printf("Tracking unavailable from '%s', cached values will expire instead\n", addr)
+				return
+			}
+			log.Printf("Tracking invalidations from '%s' lost, error: %s\n", addr, err)
+
+			// Resubscribe after a while, backing off while it keeps failing
+			if time.Since(started) > maxBackoffFactor*resubscribeDelay {
+				retry = 0
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff(resubscribeDelay, retry)):
+			}
+		}
+	}()
+}
+
+func stopTrackingListener() {
+
+	if trackingStop == nil {
+		return
+	}
+	close(trackingStop)
+	trackingStop = nil
+
+	trackingLock.Lock()
+	defer trackingLock.Unlock()
+
+	for _, client := range trackingClients {
+		client.Close()
+	}
+	trackingClients = nil
+}
+
+// listenForInvalidations subscribes to invalidation messages on one
+// connection and enables tracking, redirected to it, on another. The
+// cached keys are evicted as the messages arrive until either fails.
+func listenForInvalidations(addr string, prefixes []string) error {
+
+	sub, err := createRedisClient(addr)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	tracker, err := createRedisClient(addr)
+	if err != nil {
+		return err
+	}
+	defer tracker.Close()
+
+	trackingLock.Lock()
+	trackingClients = []*redis.Client{sub, tracker}
+	trackingLock.Unlock()
+
+	resp := sub.Cmd("CLIENT", "ID")
+	id, err := resp.Int64()
+	if err != nil {
+		return trackingError(resp, err)
+	}
+	resp = sub.Cmd("SUBSCRIBE", invalidateChannel)
+	if resp.Err != nil {
+		return trackingError(resp, resp.Err)
+	}
+
+	args := []interface{}{"TRACKING", "ON", "REDIRECT", id, "BCAST"}
+	for _, prefix := range prefixes {
+		args = append(args, "PREFIX", prefix)
+	}
+	resp = tracker.Cmd("CLIENT", args...)
+	if resp.Err != nil {
+		return trackingError(resp, resp.Err)
+	}
+
+	// Changes may have been missed while not tracking
+	invalidateAll()
+	log.Printf("Tracking invalidations from '%s'\n", addr)
+
+	for {
+		resp = sub.ReadResp()
+		if redis.IsTimeout(resp) {
+			// Tracking stops if the tracking connection is closed
+			if err = tracker.Cmd("PING").Err; err != nil {
+				return err
+			}
+			continue
+		}
+		if resp.Err != nil {
+			return resp.Err
+		}
+		invalidateMessage(respFromRadix(resp))
+	}
+}
+
+// trackingError distinguishes an upstream without tracking from a lost one.
+func trackingError(resp *redis.Resp, err error) error {
+
+	if resp.IsType(redis.AppErr) {
+		return errTrackingUnsupported
+	}
+	return err
+}
+
+// invalidateMessage evicts the keys listed in an invalidation message,
+// which is published to the channel over RESP2 or (as the connection
+// reads it, an array) pushed over RESP3; a nil list (sent on FLUSHDB or
+// FLUSHALL) means all keys.
+func invalidateMessage(msg respValue) {
+
+	var payload respValue
+	switch {
+	case len(msg.elems) == 3 && string(msg.elems[0].str) == "message" && string(msg.elems[1].str) == invalidateChannel:
+		payload = msg.elems[2]
+	case len(msg.elems) == 2 && string(msg.elems[0].str) == "invalidate":
+		payload = msg.elems[1]
+	default:
+		return
+	}
+	if payload.null {
+		invalidateAll()
+		return
+	}
+	keys := make([]string, len(payload.elems))
+	for i, key := range payload.elems {
+		keys[i] = string(key.str)
+	}
+	invalidateKeys(keys...)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrackingInvalidation(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	// Stand-in upstream with CLIENT TRACKING (which the backing Redis may not have)
+	var tracking []string
+	var trackingLock sync.Mutex
+	upstream := startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "CLIENT":
+			if strings.ToUpper(string(args[1])) == "ID" {
+				return []respValue{respInt(7)}
+			}
+			trackingLock.Lock()
+			tracking = nil
+			for _, arg := range args[1:] {
+				tracking = append(tracking, string(arg))
+			}
+			trackingLock.Unlock()
+			return []respValue{respSimple("OK")}
+		case "SUBSCRIBE":
+			return []respValue{respArrayOf(respBulk([]byte("subscribe")), respBulk(args[1]), respInt(1))}
+		case "HELLO":
+			return []respValue{respMapOf(respBulk([]byte("proto")), respInt(3))}
+		}
+		return []respValue{respSimple("PONG")}
+	})
+	defer upstream.close()
+
+	delay := resubscribeDelay
+	resubscribeDelay = 10 * time.Millisecond
+	defer func() { resubscribeDelay = delay }()
+
+	startTrackingListener(upstream.addr(), []string{"key", "user:"})
+	defer stopTrackingListener()
+	upstream.waitFor(t, "SUBSCRIBE")
+	upstream.waitFor(t, "CLIENT")
+	// The listener purges the cache once tracking is enabled
+	time.Sleep(50 * time.Millisecond)
+
+	trackingLock.Lock()
+	if args := strings.Join(tracking, " "); args != "TRACKING ON REDIRECT 7 BCAST PREFIX key PREFIX user:" {
+		t.Errorf("Expected 'TRACKING ON REDIRECT 7 BCAST PREFIX key PREFIX user:'. Got '%s'", args)
+	}
+	trackingLock.Unlock()
+
+	// Invalidation messages list the changed keys
+	checkNotificationEvicts(t, "key4", func() {
+		upstream.push(respArrayOf(respBulk([]byte("message")), respBulk([]byte(invalidateChannel)), respCommand("key4")))
+	})
+
+	// A nil list means all keys
+	checkNotificationEvicts(t, "key5", func() {
+		upstream.push(respArrayOf(respBulk([]byte("message")), respBulk([]byte(invalidateChannel)), respValue{kind: respArray, null: true}))
+	})
+
+	// Losing the subscription should re-enable tracking
+	upstream.drop()
+	upstream.waitFor(t, "SUBSCRIBE")
+	upstream.waitFor(t, "CLIENT")
+	// The listener purges the cache once tracking is enabled
+	time.Sleep(50 * time.Millisecond)
+	checkNotificationEvicts(t, "key6", func() {
+		upstream.push(respArrayOf(respBulk([]byte("message")), respBulk([]byte(invalidateChannel)), respCommand("key6")))
+	})
+
+	// Over RESP3, invalidations are pushed instead
+	stopTrackingListener()
+	upstreamProtocol = 3
+	defer func() { upstreamProtocol = 2 }()
+	startTrackingListener(upstream.addr(), []string{"key", "user:"})
+	upstream.waitFor(t, "SUBSCRIBE")
+	upstream.waitFor(t, "CLIENT")
+	// The listener purges the cache once tracking is enabled
+	time.Sleep(50 * time.Millisecond)
+	checkNotificationEvicts(t, "key4", func() {
+		upstream.push(respPushOf(respBulk([]byte("invalidate")), respCommand("key4")))
+	})
+	checkNotificationEvicts(t, "key5", func() {
+		upstream.push(respPushOf(respBulk([]byte("invalidate")), respValue{kind: respNull, null: true}))
+	})
+	redisCache.lru.Purge()
+}
+
+func TestTrackingUnsupported(t *testing.T) {
+
+	// Stand-in upstream without CLIENT TRACKING
+	upstream := startStandIn(t, func(args [][]byte) []respValue {
+		return []respValue{respErr("ERR unknown command")}
+	})
+	defer upstream.close()
+
+	delay := resubscribeDelay
+	resubscribeDelay = 10 * time.Millisecond
+	defer func() { resubscribeDelay = delay }()
+
+	startTrackingListener(upstream.addr(), nil)
+	defer stopTrackingListener()
+	upstream.waitFor(t, "CLIENT")
+
+	// The listener should give up rather than retry
+	select {
+	case name := <-upstream.commands:
+		t.Errorf("Expected no further commands. Got '%s'", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,106 @@
+// upstream-ttl handles capping how long replies are cached at the time left before their keys expire upstream.
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// addTTLs adds a PTTL for each key read in the pipeline (other than by
+// PTTL or TTL themselves), returning the keys.
+func (p *upstreamPipeline) addTTLs() []string {
+
+	var keys []string
+	for _, c := range p.cmds {
+		name := strings.ToUpper(c.cmd)
+		if c.forwarded || name == "PTTL" || name == "TTL" {
+			continue
+		}
+		keys = append(keys, c.readKeys()...)
+	}
+	for _, key := range keys {
+		p.add("PTTL", key)
+	}
+	return keys
+}
+
+// readKeys returns the keys read by a cache miss: its first argument or,
+// for MGET, all of them.
+func (c upstreamCmd) readKeys() []string {
+
+	if len(c.args) == 0 {
+		return nil
+	}
+	args := c.args[:1]
+	if strings.ToUpper(c.cmd) == "MGET" {
+		args = c.args
+	}
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i], _ = redis.KeyFromArgs(arg)
+	}
+	return keys
+}
+
+// noteTTLs notes the deadline of each key from its reply to PTTL. Keys
+// which have gone (or expire as they are read) can't be cached, while
+// those with no expiry (or whose TTL couldn't be read) only expire locally.
+func (p *upstreamPipeline) noteTTLs(keys []string, replies []respValue) {
+
+	now := time.Now().UnixNano()
+	p.deadlines = make(map[string]int64)
+	for i, key := range keys {
+		ttl := replies[i].num
+		switch {
+		case replies[i].kind != respInteger || ttl == -1:
+		case ttl < 0:
+			p.deadlines[key] = now
+		default:
+			p.deadlines[key] = now + ttl*int64(time.Millisecond)
+		}
+	}
+}
+
+// deadline returns when the key read expires upstream (0 if it doesn't).
+func (p *upstreamPipeline) deadline(key string) int64 {
+
+	return p.deadlines[key]
+}
+
+func expired(deadline int64) bool {
+
+	return deadline != 0 && time.Now().UnixNano() >= deadline
+}
+
+// cachedTTL returns the time left (in milliseconds, or -1 if it doesn't
+// expire) before the key expires upstream, if any of its replies are
+// cached, so that lower tiers reading the TTL need not go upstream.
+func cachedTTL(key string) (int64, bool) {
+
+	for _, ck := range redisCache.cachedReplies(key) {
+		cached, found := redisCache.lru.Peek(ck)
+		if !found {
+			continue
+		}
+		deadline := cached.(*valueStruct).deadline
+		switch {
+		case deadline == 0:
+			return -1, true
+		case !expired(deadline):
+			return (deadline - time.Now().UnixNano()) / int64(time.Millisecond), true
+		}
+	}
+	return 0, false
+}
+
+// ttlReply converts the time left before a key expires into the reply to
+// PTTL or (rounded to the nearest second, as Redis does) TTL.
+func ttlReply(name string, ttl int64) respValue {
+
+	if name == "TTL" && ttl >= 0 {
+		ttl = (ttl + 500) / 1000
+	}
+	return respInt(ttl)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTTLUpstream starts a stand-in upstream whose keys starting 'short'
+// expire in 100ms and those starting 'gone' have expired (while others
+// don't expire), counting the PTTLs it receives.
+func startTTLUpstream(t *testing.T, pttls *int64) *standIn {
+
+	return startStandIn(t, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "GET":
+			return []respValue{respBulk([]byte("value"))}
+		case "MGET":
+			vals := make([]respValue, len(args)-1)
+			for i := range vals {
+				vals[i] = respBulk([]byte("value"))
+			}
+			return []respValue{respArrayOf(vals...)}
+		case "PTTL":
+			atomic.AddInt64(pttls, 1)
+			switch key := string(args[1]); {
+			case strings.HasPrefix(key, "short"):
+				return []respValue{respInt(100)}
+			case strings.HasPrefix(key, "gone"):
+				return []respValue{respInt(-2)}
+			}
+			return []respValue{respInt(-1)}
+		}
+		return []respValue{respSimple("OK")}
+	})
+}
+
+func TestUpstreamTTL(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	var pttls int64
+	upstream := startTTLUpstream(t, &pttls)
+	defer upstream.close()
+	ttlPool, err := createRedisPool(upstream.addr(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ttlPool.Empty()
+	backendPool := redisPool
+	redisPool = ttlPool
+	defer func() { redisPool = backendPool }()
+
+	// The TTL of each key is fetched with its value
+	if val, err := getRedisValue("shortKey"); val != "value" || err != nil {
+		t.Errorf("Expected 'value'. Got '%s' and %v", val, err)
+	}
+	getRedisMultiValues([]string{"shortMulti", "longMulti"})
+	getRedisValue("longKey")
+	if n := atomic.LoadInt64(&pttls); n != 4 {
+		t.Errorf("Expected 4 PTTLs. Got %d", n)
+	}
+
+	// And passed down to lower tiers without going upstream
+	conn := dialTest(t)
+	defer conn.conn.Close()
+	if reply := conn.do(t, "PTTL", "shortKey"); reply.kind != respInteger || reply.num <= 0 || reply.num > 100 {
+		t.Errorf("Expected a PTTL of up to 100. Got %q", appendRESP(nil, reply))
+	}
+	if reply := conn.do(t, "TTL", "shortKey"); reply.kind != respInteger || reply.num != 0 {
+		t.Errorf("Expected a TTL of 0. Got %q", appendRESP(nil, reply))
+	}
+	if reply := conn.do(t, "PTTL", "longKey"); reply.kind != respInteger || reply.num != -1 {
+		t.Errorf("Expected a PTTL of -1. Got %q", appendRESP(nil, reply))
+	}
+	if n := atomic.LoadInt64(&pttls); n != 4 {
+		t.Errorf("Expected 4 PTTLs. Got %d", n)
+	}
+	if reply := conn.do(t, "PTTL", "otherKey"); reply.kind != respInteger || reply.num != -1 {
+		t.Errorf("Expected a PTTL of -1. Got %q", appendRESP(nil, reply))
+	}
+
+	// Keys which have gone aren't cached, and others only until they expire upstream
+	getRedisValue("goneKey")
+	if _, found := getCachedValue("goneKey"); found {
+		t.Errorf("Expected 'goneKey' not to be cached")
+	}
+	time.Sleep(150 * time.Millisecond)
+	for key, cached := range map[string]bool{"shortKey": false, "shortMulti": false, "longKey": true, "longMulti": true} {
+		if _, found := getCachedValue(key); found != cached {
+			t.Errorf("Expected '%s' to be cached: %t", key, cached)
+		}
+	}
+	if reply := conn.do(t, "PTTL", "shortKey"); reply.num != 100 {
+		t.Errorf("Expected the PTTL of 100 from upstream. Got %q", appendRESP(nil, reply))
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
@@ -0,0 +1,178 @@
+// upstreams handles the routing of cache misses to replicas of the upstream Redis, failing over to the primary.
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/pool"
+)
+
+// replica is a read replica of the upstream (primary) Redis.
+type replica struct {
+	addr string
+	pool *pool.Pool
+	down int32 // set while failing health checks
+}
+
+var replicas []*replica
+
+// Successive reads are spread across the healthy replicas
+var nextReplica uint32
+
+// How often each replica is health checked
+var healthCheckInterval = time.Second
+
+// Misses for keys written through the proxy this recently are read from
+// the primary, as the replicas may not have the write yet (when the old
+// value would be cached again)
+var primaryReadWindow = time.Second
+
+// When each key (or, with FLUSHDB and such, every key) was last written,
+// while reading from replicas
+var recentWrites = make(map[string]int64)
+var recentWriteAll int64
+var recentWritesSwept int64
+var recentWritesLock sync.Mutex
+
+var replicasStop chan bool
+var replicasDone sync.WaitGroup
+
+// startReplicas opens pools of connections to the replicas (which may
+// not be up yet), health checking them until stopReplicas is called.
+func startReplicas(addrs []string, size int) {
+
+	replicas = nil
+	for _, addr := range addrs {
+		r := &replica{addr: addr}
+		var err error
+		r.pool, err = createRedisPool(addr, size)
+		if err != nil {
+			log.Printf("Error on replica connection to '%s' error: %s\n", addr, err)
+			r.down = 1
+		}
+		replicas = append(replicas, r)
+	}
+
+	stop := make(chan bool)
+	replicasStop = stop
+	replicasDone.Add(1)
+	go func() {
+		defer replicasDone.Done()
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checkReplicas()
+			}
+		}
+	}()
+}
+
+func stopReplicas() {
+
+	if replicasStop == nil {
+		return
+	}
+	close(replicasStop)
+	replicasStop = nil
+	replicasDone.Wait()
+
+	for _, r := range replicas {
+		r.pool.Empty()
+	}
+	replicas = nil
+}
+
+func checkReplicas() {
+
+	for _, r := range replicas {
+		r.note(r.pool.Cmd("PING").Err == nil)
+	}
+}
+
+// note records whether the replica could be reached, logging when it
+// is taken out of (or returned to) use.
+func (r *replica) note(ok bool) {
+
+	if ok {
+		if atomic.SwapInt32(&r.down, 0) == 1 {
+			log.Printf("Replica '%s' is healthy, reading from it\n", r.addr)
+		}
+		return
+	}
+	if atomic.SwapInt32(&r.down, 1) == 0 {
+		log.Printf("Replica '%s' is unhealthy, no longer reading from it\n", r.addr)
+	}
+}
+
+// pickReplica returns the next healthy replica, if there are any.
+func pickReplica() *replica {
+
+	var healthy []*replica
+	for _, r := range replicas {
+		if atomic.LoadInt32(&r.down) == 0 {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	return healthy[atomic.AddUint32(&nextReplica, 1)%uint32(len(healthy))]
+}
+
+// noteWrite records that the keys (or all keys) are being written.
+func noteWrite(keys []string, all bool) {
+
+	if len(replicas) == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+
+	recentWritesLock.Lock()
+	defer recentWritesLock.Unlock()
+
+	if all {
+		recentWriteAll = now
+	}
+	for _, key := range keys {
+		recentWrites[key] = now
+	}
+
+	// Writes made before the window are forgotten, every so often
+	if now-recentWritesSwept > int64(primaryReadWindow) {
+		for key, written := range recentWrites {
+			if now-written > int64(primaryReadWindow) {
+				delete(recentWrites, key)
+			}
+		}
+		recentWritesSwept = now
+	}
+}
+
+// writtenRecently reports whether any of the keys read by the commands
+// was written within the window.
+func writtenRecently(cmds []upstreamCmd) bool {
+
+	now := time.Now().UnixNano()
+
+	recentWritesLock.Lock()
+	defer recentWritesLock.Unlock()
+
+	if now-recentWriteAll < int64(primaryReadWindow) {
+		return true
+	}
+	for _, c := range cmds {
+		for _, key := range c.readKeys() {
+			if written, ok := recentWrites[key]; ok && now-written < int64(primaryReadWindow) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startNamedUpstream starts a stand-in upstream whose GETs return its name.
+func startNamedUpstream(t *testing.T, addr string, name string) *standIn {
+
+	return startStandInAt(t, addr, func(args [][]byte) []respValue {
+		switch strings.ToUpper(string(args[0])) {
+		case "GET":
+			return []respValue{respBulk([]byte(name))}
+		case "PING":
+			return []respValue{respSimple("PONG")}
+		}
+		return []respValue{respSimple("OK")}
+	})
+}
+
+func TestReplicaReads(t *testing.T) {
+
+	redisCache.lru.Purge()
+
+	interval := healthCheckInterval
+	healthCheckInterval = 10 * time.Millisecond
+	defer func() { healthCheckInterval = interval }()
+
+	primary := startNamedUpstream(t, "localhost:0", "fromPrimary")
+	defer primary.close()
+	replica := startNamedUpstream(t, "localhost:0", "fromReplica")
+	addr := replica.addr()
+	defer func() { replica.close() }()
+
+	primaryPool, err := createRedisPool(primary.addr(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryPool.Empty()
+
+	backendPool := redisPool
+	redisPool = primaryPool
+	defer func() { redisPool = backendPool }()
+
+	startReplicas([]string{addr}, 10)
+	defer stopReplicas()
+
+	window := primaryReadWindow
+	primaryReadWindow = 100 * time.Millisecond
+	defer func() { primaryReadWindow = window }()
+
+	// Cache misses are read from the replica, while writes go to the primary
+	if val, err := getRedisValue("replicaKey"); val != "fromReplica" || err != nil {
+		t.Errorf("Expected 'fromReplica'. Got '%s' and %v", val, err)
+	}
+	if buf := sendTCP(t, "SET replicaKey value\r\n"+quitRequest); string(buf) != "+OK\r\n+OK\r\n" {
+		t.Errorf("Expected '+OK\\r\\n+OK\\r\\n'. Got %q", buf)
+	}
+	primary.waitFor(t, "SET")
+
+	// Keys just written are read from the primary (which has the write) for a while
+	if val, err := getRedisValue("replicaKey"); val != "fromPrimary" || err != nil {
+		t.Errorf("Expected 'fromPrimary'. Got '%s' and %v", val, err)
+	}
+	if val, err := getRedisValue("anotherKey"); val != "fromReplica" || err != nil {
+		t.Errorf("Expected 'fromReplica'. Got '%s' and %v", val, err)
+	}
+	time.Sleep(primaryReadWindow)
+	redisCache.lru.Purge()
+	if val, err := getRedisValue("replicaKey"); val != "fromReplica" || err != nil {
+		t.Errorf("Expected 'fromReplica'. Got '%s' and %v", val, err)
+	}
+
+	// Failing over to the primary while the replica is down
+	replica.close()
+	redisCache.lru.Purge()
+	if val, err := getRedisValue("replicaKey"); val != "fromPrimary" || err != nil {
+		t.Errorf("Expected 'fromPrimary'. Got '%s' and %v", val, err)
+	}
+
+	// Until the replica is healthy again
+	replica = startNamedUpstream(t, addr, "fromReplica")
+	timeout := time.After(5 * time.Second)
+	for {
+		redisCache.lru.Purge()
+		val, _ := getRedisValue("replicaKey")
+		if val == "fromReplica" {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("Expected 'fromReplica'. Got '%s'", val)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	redisCache.lru.Purge()
+	clearCacheStats()
+}
+
+func TestHealthCheckPrimary(t *testing.T) {
+
+	// Stand-ins which each answer PING with their role
+	standIn := func(role string) *standIn {
+		return startStandIn(t, func(args [][]byte) []respValue {
+			return []respValue{respSimple(role)}
+		})
+	}
+	primary := standIn("PRIMARY")
+	defer primary.close()
+	replica := standIn("REPLICA")
+	defer replica.close()
+
+	primaryPool, err := createRedisPool(primary.addr(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryPool.Empty()
+
+	backendPool := redisPool
+	redisPool = primaryPool
+	defer func() { redisPool = backendPool }()
+
+	startReplicas([]string{replica.addr()}, 2)
+	defer stopReplicas()
+
+	// The health check is of the primary, never a replica
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		response := executeRequest(req)
+		if body := response.Body.String(); body != "PRIMARY" {
+			t.Errorf("Expected 'PRIMARY'. Got '%s'", body)
+		}
+	}
+}
+
+func TestPickReplica(t *testing.T) {
+
+	saved := replicas
+	defer func() { replicas = saved }()
+
+	replicas = []*replica{{addr: "a"}, {addr: "b", down: 1}, {addr: "c"}}
+	picked := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		picked[pickReplica().addr]++
+	}
+	if picked["a"] != 5 || picked["c"] != 5 {
+		t.Errorf("Expected reads spread across replicas a and c. Got %v", picked)
+	}
+
+	replicas[0].down, replicas[2].down = 1, 1
+	if r := pickReplica(); r != nil {
+		t.Errorf("Expected no healthy replica. Got '%s'", r.addr)
+	}
+}